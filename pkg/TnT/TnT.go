@@ -24,6 +24,9 @@
 package TnT
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"strings"
 	"fmt"
 	"regexp"
@@ -32,6 +35,10 @@ import (
 	"sort"
 	"unicode"
 	"math"
+	"net/url"
+	"hash/fnv"
+	"path/filepath"
+	"sync"
 )
 
 // **********************************************************************
@@ -40,7 +47,12 @@ const NANO = 1000000000
 const MILLI = 1000000
 const NOT_EXIST = 0
 
-const KVDIR = "/tmp/TnT_KV/"
+const PROMISE_COLLECTION = "conn"   // where the promise wrappers keep their histories
+
+// Where the KV collections live, with a trailing /. Change it only before
+// anything is learned, e.g. to replay a log into a scratch store
+
+var KVDIR = "/tmp/TnT_KV/"
 
 // ***************************************************************************
 
@@ -70,6 +82,10 @@ type PromiseHistory struct {
 	AntiT     float64    `json:"antiT"`
 
 	Units     string     `json:"units"`
+
+	// Distribution of all Q seen, for quantiles
+
+	Sketch    *QuantileSketch `json:"sketch,omitempty"`
 }
 
 // *********************************************************************
@@ -79,6 +95,17 @@ type PromiseContext struct {
 	Time  time.Time
 	Name  string
 	Plock Lock
+
+	// Span identity, for tracing (see SetSpanExporter)
+
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	TraceFlags   string  // as received from the caller, "" means sampled
+
+	holder   *LockHolder    // set when begun with a context.Context
+	children *PromiseLedger // latencies of our child promises
+	parent   *PromiseLedger // where a child reports its latency
 }
 
 // **********************************************************************
@@ -99,16 +126,19 @@ func StampedPromiseContext_Begin(name string, before time.Time) PromiseContext {
 
 	var ctx PromiseContext
 	ctx.Time = before
-	ctx.Name = KeyName(name,0)
+	ctx.Name = PromiseName(name)
+	ctx.TraceID = NewTraceID()
+	ctx.SpanID = NewSpanID()
 
 	// *** begin ANTI-SPAM/DOS PROTECTION ***********
 
-	ifelapsed := int64(30)   // these params should be policy
-	expireafter := int64(60)
+	policy := GetPromisePolicy(ctx.Name)
 
 	now := time.Now().UnixNano()
 
-	ctx.Plock = BeginService(name,ifelapsed,expireafter, now) 
+	// Lock on the canonical name, escaped to be a single filename
+
+	ctx.Plock = BeginService(url.PathEscape(ctx.Name),policy.IfElapsed,policy.ExpireAfter, now) 
 
 	// *** end ANTI-SPAM/DOS PROTECTION ***********
 
@@ -117,6 +147,120 @@ func StampedPromiseContext_Begin(name string, before time.Time) PromiseContext {
 
 // **********************************************************************
 
+func PromiseContext_BeginUnlocked(name string) PromiseContext {
+
+	before := time.Now()
+	return StampedPromiseContext_BeginUnlocked(name, before)
+}
+
+// **********************************************************************
+
+func StampedPromiseContext_BeginUnlocked(name string, before time.Time) PromiseContext {
+
+	// Measure without taking the lock, for events that may legitimately
+	// overlap (concurrent requests) or that happened long ago (replay)
+
+	var ctx PromiseContext
+	ctx.Time = before
+	ctx.Name = PromiseName(name)
+	ctx.TraceID = NewTraceID()
+	ctx.SpanID = NewSpanID()
+	ctx.Plock.Ready = true
+	return ctx
+}
+
+// **********************************************************************
+
+func PromiseContext_TryBegin(name string) (PromiseContext, error) {
+
+	before := time.Now()
+	return StampedPromiseContext_TryBegin(name, before)
+}
+
+// **********************************************************************
+
+func StampedPromiseContext_TryBegin(name string, before time.Time) (PromiseContext, error) {
+
+	// As StampedPromiseContext_Begin, but say clearly if the lock refused
+	// us, in which case the guarded work should not be done. The context
+	// can still be passed to End, which will only record the denial
+
+	ctx := StampedPromiseContext_Begin(name, before)
+
+	if !ctx.Plock.Ready {
+		return ctx, &DeniedError{ Name: ctx.Name, Reason: ctx.Plock.Reason }
+	}
+
+	return ctx, nil
+}
+
+// **********************************************************************
+
+func (ctx PromiseContext) Ready() bool {
+
+	// Did we get the lock, i.e. should the guarded work go ahead?
+
+	return ctx.Plock.Ready
+}
+
+// **********************************************************************
+
+func PromiseContext_BeginContext(parent context.Context, name string) (context.Context, PromiseContext) {
+
+	before := time.Now()
+	return StampedPromiseContext_BeginContext(parent, name, before)
+}
+
+// **********************************************************************
+
+func StampedPromiseContext_BeginContext(parent context.Context, name string, before time.Time) (context.Context, PromiseContext) {
+
+	// As StampedPromiseContext_Begin, but the returned context.Context
+	// runs out when the lock would expire (expireafter), and is cancelled
+	// with cause ErrLockExpired if another caller forces the lock first.
+	// Go threads can't be killed, so this is the "please release
+	// resources" signal that the work should watch with ctx.Done()
+
+	pctx := StampedPromiseContext_Begin(name, before)
+
+	// Join the caller's trace, and let nested promises join ours
+
+	if sc, ok := SpanFromContext(parent); ok {
+		pctx.JoinSpan(sc)
+	}
+
+	parent = ContextWithSpan(parent,pctx.SpanContext())
+
+	policy := GetPromisePolicy(pctx.Name)
+
+	cctx, cancel := context.WithCancelCause(parent)
+
+	if !pctx.Plock.Ready {
+
+		// We don't hold the lock, so there is nothing to do
+
+		cancel(&DeniedError{ Name: pctx.Name, Reason: pctx.Plock.Reason })
+		return cctx, pctx
+	}
+
+	var stop context.CancelFunc = func() {}
+
+	if policy.ExpireAfter > 0 {
+		// The lock was taken now, whatever the stamp says, e.g. in a replay
+
+		deadline := time.Now().Add(time.Duration(policy.ExpireAfter) * time.Second)
+		cctx, stop = context.WithDeadlineCause(cctx, deadline, ErrLockExpired)
+	}
+
+	pctx.holder = &LockHolder{ cancel: cancel, stop: stop }
+
+	RegisterLockHolder(pctx.Plock.This, pctx.holder)
+
+	return cctx, pctx
+}
+
+// **********************************************************************
+
 func PromiseContext_End(ctx PromiseContext) PromiseHistory {
 
 	after := time.Now()
@@ -127,31 +271,106 @@ func PromiseContext_End(ctx PromiseContext) PromiseHistory {
 
 func StampedPromiseContext_End(ctx PromiseContext, after time.Time) PromiseHistory {
 
-	before := ctx.Time
+	return StampedPromiseContext_EndQuality(ctx,after,1)
+}
+
+// **********************************************************************
+
+func PromiseContext_EndQuality(ctx PromiseContext, quality float64) PromiseHistory {
+
+	after := time.Now()
+	return StampedPromiseContext_EndQuality(ctx,after,quality)
+}
+
+// **********************************************************************
+
+func StampedPromiseContext_EndQuality(ctx PromiseContext, after time.Time, quality float64) PromiseHistory {
 
-	EndService(ctx.Plock)
+	// As End, and if the promise was declared, assess the outcome against
+	// it with the quality of the payload (0 to 1) as assessed by the caller
 
-	const collname = "conn"
+	before := ctx.Time
+
+	collname := PROMISE_COLLECTION
 	var key string
 
+	// A child's path, e.g. deploy/fetch, is its key, and is never
+	// flattened onto its parent or onto a flat name like "deploy fetch"
+
+	name := PromiseKey(ctx.Name)
+
 	// Semantic donut time key ..
 
-	_, timeslot := DoughNowt(time.Now())
+	_, timeslot := DoughNowt(after)
 	
-	if ctx.Name == "" {
+	if name == "" {
 		key = timeslot
 	} else {
-		key = ctx.Name+":"+timeslot
+		key = name+":"+timeslot
+	}
+
+	if !ctx.Plock.Ready {
+
+		// The promise was refused, so the lock belongs to someone else
+		// and there is no new sample to learn from
+
+		var event PromiseEvent
+
+		event.Kind = EVENT_DENIED
+		event.Name = ctx.Name
+		event.Key = collname+":"+key
+		event.Time = after
+		event.Lock = ctx.Plock.This
+		event.Ready = false
+		event.Reason = ctx.Plock.Reason
+		event.TraceID = ctx.TraceID
+		event.SpanID = ctx.SpanID
+
+		EmitPromiseEvent(event)
+
+		ExportPromiseSpan(PromiseSpan(ctx,after,map[string]any{
+			"tnt.promise.key": key,
+			"tnt.lock.ready": false,
+			"tnt.lock.reason": ctx.Plock.Reason,
+		}))
+
+		_, e := GetPromiseHistory(collname,key)
+		return e
+	}
+
+	if ctx.Plock.This != "" {
+		EndService(ctx.Plock)
+	}
+
+	if ctx.holder != nil {
+		ReleaseLockHolder(ctx.Plock.This, ctx.holder)
 	}
 	
 	// make b = promise execution interval (latency) in this case
 
 	b := float64(after.Sub(before)) // time difference now-previous
 
-	// Direct db writes, these are separated from the time-based averaging
+	// Direct db writes, these are separated from the time-based averaging.
+	// Swap in the new values under one lock, so overlapping ends of the
+	// same promise each see a consistent previous sample
+
+	var lastlatency,lasttime KeyValue
+
+	lastlatency.K = name+"latency"
+	lastlatency.V = b
+
+	lasttime.K = name+"lastseen"
+	lasttime.V = float64(after.UnixNano())
+
+	unlock := LockKV(collname,lasttime.K)
+
+	previous_value := GetKV(collname,lastlatency.K)
+	previous_time := GetKV(collname,lasttime.K)
 
-	previous_value := GetKV(collname,ctx.Name+"latency")
-	previous_time := GetKV(collname,ctx.Name+"lasteen")
+	AddKV(collname,lastlatency)
+	AddKV(collname,lasttime)
+
+	unlock()
 
 	var dt,db float64
 
@@ -167,36 +386,65 @@ func StampedPromiseContext_End(ctx PromiseContext, after time.Time) PromiseHisto
  		db = b - previous_value.V
 	}
 
-	dtau := dt/db * b
+	// Equal consecutive latencies, or two ends at the same time, leave
+	// these undefined. JSON can't carry Inf or NaN, so they stay 0
 
-	e := LearnUpdateKeyValue(collname,key,time.Now().UnixNano(),b,"ns")
+	var dtau,derivative float64
 
-	var lastlatency,lasttime KeyValue
+	if db != 0 {
+		dtau = dt/db * b
+	}
 
-	// Make the values latency
+	if dt != 0 {
+		derivative = db/dt
+	}
 
-	lastlatency.K = ctx.Name+"latency"
-	lastlatency.V = b
+	e := LearnPromiseSample(name,"latency",after,b,"ns")
+
+	var event PromiseEvent
+
+	event.Kind = EVENT_END
+	event.Name = ctx.Name
+	event.Key = collname+":"+key
+	event.Time = after
+	event.Lock = ctx.Plock.This
+	event.Ready = ctx.Plock.Ready
+	event.Latency = b
+	event.Q_av = e.Q_av
+	event.Delta = db
+	event.Derivative = derivative
+	event.Dt = dt
+	event.Dtau = dtau
+	event.Dt_av = e.Dt_av
+	event.TraceID = ctx.TraceID
+	event.SpanID = ctx.SpanID
+
+	EmitPromiseEvent(event)
+
+	if p, declared := GetPromise(name); declared {
+		AssessDeclaredPromise(p,e,quality)
+	}
 
-	lasttime.K = ctx.Name+"lastseen"
-	lasttime.V = float64(after.UnixNano())
+	attrs := map[string]any{
+		"tnt.promise.key": key,
+		"tnt.lock.ready": true,
+		"tnt.latency.ns": b,
+		"tnt.latency.derivative": derivative,
+		"tnt.latency.q_av": e.Q_av,
+	}
 
-	fmt.Println("------- INSTRUMENTATION --------------")
+	// The most recent assessment, if anyone has assessed this promise
 
-	AddKV(collname,lastlatency)
-	AddKV(collname,lasttime)
+	if r := GetKV("PromiseKeeping",key); r.V != 0 {
+		attrs["tnt.reliability"] = r.V
+	}
+
+	ExportPromiseSpan(PromiseSpan(ctx,after,attrs))
+
+	if ctx.parent != nil {
+		ctx.parent.Add(ctx.Name,b)
+	}
 
-	fmt.Println("   Location:", ctx.Name+collname)
-	fmt.Println("   Promise duration b (ms)", e.Q/MILLI,"=",b/MILLI)
-	fmt.Println("   Running average 50/50", e.Q_av/NANO)
-
-	fmt.Println("   Change in promise since last sample",db)
-	fmt.Println("   Promise derivative b/s", db/dt)
-	fmt.Println("")
-	fmt.Println("   Time since last sample (s) phase",dt/NANO)
-	fmt.Println("   Time signal uncertainty dtau (s) group",dtau/NANO)
-	fmt.Println("   Running average sampling interval",e.Dt_av/NANO)
-	fmt.Println("------- INSTRUMENTATION --------------")
 	return e
 }
 
@@ -204,6 +452,44 @@ func StampedPromiseContext_End(ctx PromiseContext, after time.Time) PromiseHisto
 
 func AssessPromiseOutcome(e PromiseHistory, assessed_quality,promise_upper_bound,trust_interval float64) float64 {
 
+	// Judge the latest sample with the Assessor selected for this promise
+	// name (see SetAssessor), LogisticAssessor by default
+
+	a := GetAssessor(e.PromiseId).Assess(e,assessed_quality,promise_upper_bound,trust_interval)
+
+	var event PromiseEvent
+
+	event.Kind = EVENT_ASSESS
+	event.Key = "PromiseKeeping:"+e.PromiseId
+	event.Name = e.PromiseId
+	event.Time = time.Now()
+	event.Ready = true
+	event.Latency = e.Q
+	event.Bound = promise_upper_bound
+	event.Interval = trust_interval
+	event.Quality = assessed_quality
+	event.Level = a.Level
+	event.LevelSigma = a.LevelSigma
+	event.Dqdt = a.Dqdt.Value
+	event.DqdtSigma = a.Dqdt.Sigma
+	event.D2qdt2 = a.D2qdt2.Value
+	event.D2qdt2Sigma = a.D2qdt2.Sigma
+	event.Previous = a.Previous
+	event.Reliability = a.Reliability
+	event.Delta = a.Delta
+	event.Notes = a.Notes
+
+	EmitPromiseEvent(event)
+
+	return a.Reliability
+}
+
+// **********************************************************************
+
+func (l LogisticAssessor) Assess(e PromiseHistory, assessed_quality,promise_upper_bound,trust_interval float64) Assessment {
+
+	l = l.defaults()
+
 	promised_ns := promise_upper_bound * NANO
 	trust_ns := trust_interval * NANO
 
@@ -222,33 +508,23 @@ func AssessPromiseOutcome(e PromiseHistory, assessed_quality,promise_upper_bound
 
 	// The trouble is that we don't usually know what was promised...
 
-	promise_level := 1/(1+math.Exp(3*(e.Q-promised_ns)/promised_ns))
+	promise_level := 1/(1+math.Exp(l.Slope*(e.Q-promised_ns)/promised_ns))
 
-	fmt.Println("Promise level",promise_level,"+-",sig/promised_ns,"raw",e.Q/NANO,promise_upper_bound)
+	var notes []string
 
 	if e.Dt_av == 0 {
 		e.Dt_av = 1.0
 	}
 
-	fmt.Println("Assessing expected sampling interval",float64(e.T)/e.Dt_av)
-	fmt.Println("Assessing desired sampling interval",float64(e.T)/trust_ns)
+	notes = append(notes,fmt.Sprintf("Assessing expected sampling interval %v",float64(e.T)/e.Dt_av))
+	notes = append(notes,fmt.Sprintf("Assessing desired sampling interval %v",float64(e.T)/trust_ns))
 
 	// The assessed payload is the user defined arbitrary up or downvote
 	// How well did we keep our promise payload?
 
-	fmt.Println("Assessing expected Q level",float64(e.Q)/e.Q_av)
-	fmt.Println("Assessing desired Q level",float64(e.Q)/promised_ns)
-	fmt.Println("Assessing payload",assessed_quality)
-	fmt.Println("Assessing level change",(e.Q-e.Q1)/promised_ns)
-
-	// Get our previous estimate of reliability
-
-	reliability := GetKV("PromiseKeeping",key)
-
-	if reliability.V == 0 {
-
-		reliability.V = 0.5 // Start evens
-	}
+	notes = append(notes,fmt.Sprintf("Assessing expected Q level %v",float64(e.Q)/e.Q_av))
+	notes = append(notes,fmt.Sprintf("Assessing desired Q level %v",float64(e.Q)/promised_ns))
+	notes = append(notes,fmt.Sprintf("Assessing level change %v",(e.Q-e.Q1)/promised_ns))
 
 	// Q is always positive (latency here...)
  	// Some assessments of the event's general timeliness
@@ -258,34 +534,36 @@ func AssessPromiseOutcome(e PromiseHistory, assessed_quality,promise_upper_bound
 
 	if math.Abs(e.Q_av) < sig {  // Down vote for noisy behaviour
 
-		fmt.Println("1.PENALTY!")
-		delta = delta / 1.5
+		notes = append(notes,"1.PENALTY!")
+		delta = delta / l.NoisePenalty
 	}
 
 	// derivatives are possible signs of stress / coping (confidence)
 	// if first first second derivatives are growing, this is not good for latency
 
-	dqdt := FirstDerivative(e,promised_ns,trust_ns)
-	d2qdt2 := SecondDerivative(e,promised_ns,trust_ns)
+	// Only trends that stand out from the noise in the samples count
 
-	const sensitivity = 0.01 // should this be the same for 1st and second?
+	dqdt := EstimateFirstDerivative(e,promised_ns,trust_ns)
+	d2qdt2 := EstimateSecondDerivative(e,promised_ns,trust_ns)
 
-	if dqdt < -sensitivity {
-		fmt.Println("Gradient reducing (spot measure)")
-		delta = delta + 0.1
-	} else if dqdt > sensitivity {
-		fmt.Println("Gradient increasing (spot measure)")
-		delta = delta - 0.1
-		fmt.Println("2.PENALTY!")
+	switch dqdt.Significant(SIGNIFICANCE) {
+	case -1:
+		notes = append(notes,"Gradient reducing "+dqdt.String())
+		delta = delta + l.Step
+	case 1:
+		notes = append(notes,"Gradient increasing "+dqdt.String())
+		delta = delta - l.Step
+		notes = append(notes,"2.PENALTY!")
 	}
 
-	if d2qdt2 < -sensitivity {
-		fmt.Println("Curvature decelerating (positive force)")
-		delta = delta + 0.1
-	} else if d2qdt2 > sensitivity {
-		fmt.Println("Curvature accelerating (negative force)")
-		delta = delta - 0.1
-		fmt.Println("3.PENALTY!")
+	switch d2qdt2.Significant(SIGNIFICANCE) {
+	case -1:
+		notes = append(notes,"Curvature decelerating (positive force) "+d2qdt2.String())
+		delta = delta + l.Step
+	case 1:
+		notes = append(notes,"Curvature accelerating (negative force) "+d2qdt2.String())
+		delta = delta - l.Step
+		notes = append(notes,"3.PENALTY!")
 	}
 
 	//if math.Fabs(SecondDeriv(e)) > SCALE {
@@ -294,223 +572,646 @@ func AssessPromiseOutcome(e PromiseHistory, assessed_quality,promise_upper_bound
 
 	// Adjust reliability according to timing AND quality
 
-	fmt.Println("Old ML running reliability(delta)",reliability.V)
-
 	if delta < 0 {
 
 		delta = 0
 	}
 
-	reliability.K = key
-	reliability.V = reliability.V * 0.4 + delta * 0.6
+	var a Assessment
 
-	fmt.Println("New ML running reliability(delta)",reliability.V,delta)
+	a.Previous, a.Reliability = BlendReliability(key,delta,l.Memory)
 
-	AddKV("PromiseKeeping",reliability)
+	a.Level = promise_level
+	a.LevelSigma = sig/promised_ns
+	a.Dqdt = dqdt
+	a.D2qdt2 = d2qdt2
+	a.Delta = delta
+	a.Notes = notes
 
-	return reliability.V
+	return a
 }
 
-// ****************************************************************************
-// Heuristic context, CFEngine style
-// ****************************************************************************
+// **********************************************************************
 
-var CONTEXT map[string]float64
+func UpdateReliability(key string, delta float64) (float64,float64) {
 
-// *******************************************************************************
+	return BlendReliability(key,delta,RELIABILITY_MEMORY)
+}
 
-func ContextActive(s string) {
+// **********************************************************************
 
-	// Machine learn in a Bayesian fashion a context state assumed true if called
+func BlendReliability(key string, delta, memory float64) (float64,float64) {
 
-	CONTEXT[s] = 0.5 + 0.5 * CONTEXT[s]
+	return blendReliability("PromiseKeeping",key,delta,memory)
 }
 
-// *******************************************************************************
+// **********************************************************************
 
-func ContextSet() []string {
+func blendReliability(collname, key string, delta, memory float64) (float64,float64) {
 
-	var result []string
+	// Blend a new promise-kept degree into the running reliability in
+	// collname, keeping a fraction memory of the old value, and return
+	// the previous and the new value. Hold the key until the new one is
+	// written so concurrent assessments don't lose updates
 
-	for s := range CONTEXT {
-		if CONTEXT[s] > 0 {
-			result = append(result,s)
-		}
-	}
+	unlock := LockKV(collname,key)
+	defer unlock()
 
-	sort.Strings(result)
+	reliability := GetKV(collname,key)
 
-	return result
-}
+	if !isFinite(delta) {
+		fmt.Println("Rejected assessment for",key,delta,ErrNotFinite)
+		return reliability.V, reliability.V
+	}
 
-// *******************************************************************************
+	if reliability.V == 0 {
 
-func InitializeContext() {
+		reliability.V = 0.5 // Start evens
+	}
 
-	// Reset / empty all signal values in context
+	previous := reliability.V
 
-	if !IsDir(KVDIR) {
-		
-		os.MkdirAll(KVDIR, 0755)
-	}
+	reliability.K = key
+	reliability.V = reliability.V * memory + delta * (1 - memory)
+
+	AddKV(collname,reliability)
 
-	CONTEXT = make(map[string]float64)
+	return previous, reliability.V
 }
 
+// ****************************************************************************
+// Heuristic context, CFEngine style
+// ****************************************************************************
+
+const CONTEXT_FORGET = 0.01  // a fading confidence below this is forgotten
+
 // *******************************************************************************
 
-func SetContext(s string,c float64) {
+type ContextDecay struct {
 
-	// Set the probability / confidence of the identifer explicitly
+	// How a context identifier fades after it was last reinforced by
+	// Activate or Set, like CFEngine's persistent classes
 
-	CONTEXT[s] = c
+	HalfLife float64  // time for the confidence to halve (s), 0 never fades
+	TTL      float64  // time after which it is forgotten (s), 0 never expires
 }
 
 // *******************************************************************************
 
-func IsDefinedContext(s string) bool {
+type contextValue struct {
 
-	// Evalute general boolean expressions CFEngine style
+	V float64    // the confidence when last reinforced
+	T time.Time  // when last reinforced
+}
 
-	r,confidence := ContextEval(s)
+// *******************************************************************************
 
-	if r == "bad expression" {
-		fmt.Println("Bad context expression:",s)
-	}
+type Context struct {
 
-	return (confidence > 0)
+	// A set of context identifiers with confidences between 0 and 1, e.g.
+	// one per tenant or agent. The zero value is an empty context
+
+	lock    sync.RWMutex
+	values  map[string]contextValue
+	decay   map[string]ContextDecay  // by identifier or * pattern
+	algebra Algebra                  // how expressions combine, the zero value is the product
 }
 
-// *******************************************************************************
+// The context used by the package level functions
 
-func Confidence(s string) float64 {
+var DEFAULT_CONTEXT = NewContext()
 
-	// Evalute a real number return for expressions CFEngine style
+// *******************************************************************************
 
-	_,confidence := ContextEval(s)
+func NewContext() *Context {
 
-	return confidence
+	return &Context{ values: make(map[string]contextValue), decay: make(map[string]ContextDecay) }
 }
 
-// ***********************************************************************
+// *******************************************************************************
 
-func ContextEval(s string) (string,float64) {
+func (c *Context) SetDecay(pattern string, d ContextDecay) {
 
-	// Return an estimated confidence in the quasi-Boolean expression s
+	// Select how identifiers matching a name or * pattern fade. The exact
+	// name wins, then the most specific pattern. The zero ContextDecay
+	// removes it, and identifiers without one never fade
 
-	expr := CleanExpression(s)
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	or_parts := SplitWithParensIntact(expr,'|')
+	if c.decay == nil {
+		c.decay = make(map[string]ContextDecay)
+	}
 
-	or_result := 0.0
+	if d == (ContextDecay{}) {
+		delete(c.decay,pattern)
+	} else {
+		c.decay[pattern] = d
+	}
+}
 
-	for or_frag := range or_parts {
+// *******************************************************************************
 
-		and_parts := SplitWithParensIntact(or_parts[or_frag],'.') 
+func (c *Context) GetDecay(s string) ContextDecay {
 
-		and_result := 1.0
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-		for and_frag := range and_parts {
+	return c.decayOf(s)
+}
 
-			if s[0] == '(' && and_parts[and_frag] == s {
-				fmt.Println("\nIrreducible context expression: ",s,"\n")
-				return "bad expression", -1.0
-			}
+// *******************************************************************************
 
-			var res float64
-			token := strings.TrimSpace(and_parts[and_frag])
-			
-			switch token[0] {
-
-			case '!':
-				switch token[1] {
-				case '(': 
-					_,res = ContextEval(token[1:])
-				default:
-					res = CONTEXT[token[1:]]
-				}
+func (c *Context) decayOf(s string) ContextDecay {
 
-				if res > 0 {
-					res = 0
-				} else {
-					res = 1
-				}
+	// Called with the lock held
 
-			case '(': 
-				_,res = ContextEval(token)
-			default:
-				res = CONTEXT[token]
-			}
+	if d, ok := c.decay[s]; ok {
+		return d
+	}
+
+	var patterns []string
 
-			// P(A and B) = AB
-			and_result *= res
+	for pattern := range c.decay {
+		if strings.Contains(pattern,"*") {
+			patterns = append(patterns,pattern)
 		}
+	}
 
-		// P(A or B) ~ (A + B - AB)
-		or_result += and_result - (or_result) * and_result
+	if pattern, ok := MostSpecificPattern(patterns,s); ok {
+		return c.decay[pattern]
 	}
 
-	return expr,or_result
+	return ContextDecay{}
 }
 
-// ***********************************************************************
-
-func CleanExpression(s string) string {
+// *******************************************************************************
 
-	s = TrimParen(s)
-	r1 := regexp.MustCompile("[|]+") 
-	s = r1.ReplaceAllString(s,"|") 
-	r2 := regexp.MustCompile("[&]+") 
-	s = r2.ReplaceAllString(s,".") 
-	r3 := regexp.MustCompile("[.]+") 
-	s = r3.ReplaceAllString(s,".") 
+func (c *Context) valueAt(s string, now time.Time) float64 {
 
-	return s
-}
+	// The confidence of s as it has faded by now. Called with the lock held
 
-// ***********************************************************************
+	cv, ok := c.values[s]
 
-func SplitWithParensIntact(expr string,split_ch byte) []string {
+	if !ok {
+		return 0
+	}
 
-	var token string = ""
-	var set []string
+	d := c.decayOf(s)
+	age := now.Sub(cv.T).Seconds()
 
-	for c := 0; c < len(expr); c++ {
+	if age < 0 {
+		age = 0
+	}
 
-		switch expr[c] {
+	if d.TTL > 0 && age > d.TTL {
+		return 0
+	}
 
-		case split_ch:
-			set = append(set,token)
-			token = ""
+	if d.HalfLife > 0 {
 
-		case '(':
-			subtoken,offset := Paren(expr,c)
-			token += subtoken
-			c = offset-1
+		v := cv.V * math.Pow(0.5,age / d.HalfLife)
 
-		default:
-			token += string(expr[c])
+		if v < CONTEXT_FORGET {
+			return 0
 		}
-	}
 
-	if len(token) > 0 {
-		set = append(set,token)
+		return v
 	}
 
-	return set
-} 
+	return cv.V
+}
 
-// ***********************************************************************
+// *******************************************************************************
 
-func Paren(s string, offset int) (string,int) {
+func (c *Context) Activate(s string) {
 
-	var level int = 0
+	c.StampedActivate(s,time.Now())
+}
 
-	for c := offset; c < len(s); c++ {
+// *******************************************************************************
 
-		if s[c] == '(' {
-			level++
-			continue
+func (c *Context) StampedActivate(s string, now time.Time) {
+
+	// Machine learn in a Bayesian fashion a context state assumed true if
+	// called. What was learned before has faded since it was reinforced
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]contextValue)
+	}
+
+	c.values[s] = contextValue{ V: 0.5 + 0.5 * c.valueAt(s,now), T: now }
+}
+
+// *******************************************************************************
+
+func (c *Context) Set(s string, confidence float64) {
+
+	c.StampedSet(s,confidence,time.Now())
+}
+
+// *******************************************************************************
+
+func (c *Context) StampedSet(s string, confidence float64, now time.Time) {
+
+	// Set the probability / confidence of the identifer explicitly
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]contextValue)
+	}
+
+	c.values[s] = contextValue{ V: confidence, T: now }
+}
+
+// *******************************************************************************
+
+func (c *Context) Get(s string) float64 {
+
+	return c.StampedGet(s,time.Now())
+}
+
+// *******************************************************************************
+
+func (c *Context) StampedGet(s string, now time.Time) float64 {
+
+	// The confidence of one identifier at time now, 0 if undefined
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.valueAt(s,now)
+}
+
+// *******************************************************************************
+
+func (c *Context) Members() []string {
+
+	// The identifiers that are at all true, sorted. Faded or expired
+	// identifiers are pruned
+
+	var result []string
+
+	now := time.Now()
+
+	c.lock.Lock()
+
+	for s := range c.values {
+		if c.valueAt(s,now) > 0 {
+			result = append(result,s)
+		} else if d := c.decayOf(s); d.HalfLife > 0 || d.TTL > 0 {
+			delete(c.values,s)
+		}
+	}
+
+	c.lock.Unlock()
+
+	sort.Strings(result)
+
+	return result
+}
+
+// *******************************************************************************
+
+func (c *Context) Values() map[string]float64 {
+
+	// A copy of the confidences as they have faded by now, in place of
+	// the old exported CONTEXT map. Writing to it changes nothing
+
+	result := make(map[string]float64)
+
+	now := time.Now()
+
+	c.lock.RLock()
+
+	for s := range c.values {
+		if v := c.valueAt(s,now); v > 0 {
+			result[s] = v
+		}
+	}
+
+	c.lock.RUnlock()
+
+	return result
+}
+
+// *******************************************************************************
+
+func (c *Context) Reset() {
+
+	c.lock.Lock()
+	c.values = make(map[string]contextValue)
+	c.lock.Unlock()
+}
+
+// *******************************************************************************
+
+func (c *Context) SetAlgebra(a Algebra) {
+
+	// Select how this context's expressions combine, e.g. ZADEH_ALGEBRA
+	// for an idempotent AND
+
+	c.lock.Lock()
+	c.algebra = a
+	c.lock.Unlock()
+}
+
+// *******************************************************************************
+
+func (c *Context) GetAlgebra() Algebra {
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.algebra.And == nil && c.algebra.Or == nil && c.algebra.Not == nil {
+		return PRODUCT_ALGEBRA
+	}
+
+	return c.algebra.defaults()
+}
+
+// *******************************************************************************
+
+func (c *Context) Eval(s string) (float64,error) {
+
+	// The confidence in the expression s, or an *ExprError
+
+	x, err := Compile(s)
+
+	if err != nil {
+		return -1.0, err
+	}
+
+	return c.EvalExpr(x), nil
+}
+
+// *******************************************************************************
+
+func (c *Context) EvalExpr(x *Expr) float64 {
+
+	return c.StampedEvalExpr(x,time.Now())
+}
+
+// *******************************************************************************
+
+func (c *Context) EvalExprWith(x *Expr, a Algebra) float64 {
+
+	// As EvalExpr, with an algebra for this expression only
+
+	return c.StampedEvalExprWith(x,a,time.Now())
+}
+
+// *******************************************************************************
+
+func (c *Context) StampedEvalExpr(x *Expr, now time.Time) float64 {
+
+	// Evaluate a compiled expression against a consistent view of the
+	// context, as it has faded by time now
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return x.EvalWith(func(name string) float64 { return c.valueAt(name,now) },c.algebra)
+}
+
+// *******************************************************************************
+
+func (c *Context) StampedEvalExprWith(x *Expr, a Algebra, now time.Time) float64 {
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return x.EvalWith(func(name string) float64 { return c.valueAt(name,now) },a)
+}
+
+// *******************************************************************************
+
+func (c *Context) IsDefined(s string) bool {
+
+	// True if s is at all true, a bad expression is not
+
+	confidence, err := c.Eval(s)
+	return err == nil && confidence > 0
+}
+
+// *******************************************************************************
+// The original functions, on the DEFAULT_CONTEXT
+// *******************************************************************************
+
+func ContextActive(s string) {
+
+	DEFAULT_CONTEXT.Activate(s)
+}
+
+// *******************************************************************************
+
+func ContextSet() []string {
+
+	return DEFAULT_CONTEXT.Members()
+}
+
+// *******************************************************************************
+
+func ContextValues() map[string]float64 {
+
+	return DEFAULT_CONTEXT.Values()
+}
+
+// *******************************************************************************
+
+func InitializeContext() {
+
+	// Reset / empty all signal values in context
+
+	if !IsDir(KVDIR) {
+		
+		os.MkdirAll(KVDIR, 0755)
+	}
+
+	DEFAULT_CONTEXT.Reset()
+}
+
+// *******************************************************************************
+
+func SetContext(s string,c float64) {
+
+	DEFAULT_CONTEXT.Set(s,c)
+}
+
+// *******************************************************************************
+
+func SetContextDecay(pattern string, d ContextDecay) {
+
+	DEFAULT_CONTEXT.SetDecay(pattern,d)
+}
+
+// *******************************************************************************
+
+func SetContextAlgebra(a Algebra) {
+
+	DEFAULT_CONTEXT.SetAlgebra(a)
+}
+
+// *******************************************************************************
+
+func IsDefinedContext(s string) bool {
+
+	// Evalute general boolean expressions CFEngine style
+
+	defined, err := TryIsDefinedContext(s)
+
+	if err != nil {
+		fmt.Println("Bad context expression:",err)
+	}
+
+	return defined
+}
+
+// *******************************************************************************
+
+func TryIsDefinedContext(s string) (bool,error) {
+
+	// As IsDefinedContext, but a bad expression is an *ExprError
+
+	_, confidence, err := TryContextEval(s)
+	return confidence > 0, err
+}
+
+// *******************************************************************************
+
+func Confidence(s string) float64 {
+
+	// Evalute a real number return for expressions CFEngine style
+
+	_,confidence := ContextEval(s)
+
+	return confidence
+}
+
+// ***********************************************************************
+
+func ContextEval(s string) (string,float64) {
+
+	// Return an estimated confidence in the quasi-Boolean expression s,
+	// and its canonical form. Compile() once instead on hot paths
+
+	x, err := Compile(s)
+
+	if err != nil {
+		return "bad expression", -1.0
+	}
+
+	return x.String(), x.Confidence()
+}
+
+// ***********************************************************************
+
+func TryContextEval(s string) (string,float64,error) {
+
+	// As ContextEval, but a bad expression is reported as an *ExprError,
+	// with the column, what was expected and a snippet
+
+	x, err := Compile(s)
+
+	if err != nil {
+		return "bad expression", -1.0, err
+	}
+
+	return x.String(), x.Confidence(), nil
+}
+
+// ***********************************************************************
+
+func CheckContextExpression(s string) error {
+
+	// For policy loaders, to reject bad rules when they are read rather
+	// than treat them as false every time they are evaluated
+
+	_, err := Compile(s)
+	return err
+}
+
+// ***********************************************************************
+
+func (x *Expr) Confidence() float64 {
+
+	// Evaluate against the DEFAULT_CONTEXT
+
+	return DEFAULT_CONTEXT.EvalExpr(x)
+}
+
+// ***********************************************************************
+
+func (x *Expr) ConfidenceWith(a Algebra) float64 {
+
+	// As Confidence, with an algebra for this expression only
+
+	return DEFAULT_CONTEXT.EvalExprWith(x,a)
+}
+
+// ***********************************************************************
+
+func CleanExpression(s string) string {
+
+	s = TrimParen(s)
+	r1 := regexp.MustCompile("[|]+") 
+	s = r1.ReplaceAllString(s,"|") 
+	r2 := regexp.MustCompile("[&]+") 
+	s = r2.ReplaceAllString(s,".") 
+	r3 := regexp.MustCompile("[.]+") 
+	s = r3.ReplaceAllString(s,".") 
+
+	return s
+}
+
+// ***********************************************************************
+
+func SplitWithParensIntact(expr string,split_ch byte) []string {
+
+	var token string = ""
+	var set []string
+
+	for c := 0; c < len(expr); c++ {
+
+		switch expr[c] {
+
+		case split_ch:
+			set = append(set,token)
+			token = ""
+
+		case '(':
+			subtoken,offset := Paren(expr,c)
+			token += subtoken
+			c = offset-1
+
+		default:
+			token += string(expr[c])
+		}
+	}
+
+	if len(token) > 0 {
+		set = append(set,token)
+	}
+
+	return set
+} 
+
+// ***********************************************************************
+
+func Paren(s string, offset int) (string,int) {
+
+	var level int = 0
+
+	for c := offset; c < len(s); c++ {
+
+		if s[c] == '(' {
+			level++
+			continue
 		}
 
 		if s[c] == ')' {
@@ -537,85 +1238,219 @@ func TrimParen(s string) string {
 		return s
 	}
 
-	s = strings.TrimSpace(s)
+	s = strings.TrimSpace(s)
+
+	if s[0] != '(' {
+		return s
+	}
+
+	for c := 0; c < len(s); c++ {
+
+		if s[c] == '(' {
+			level++
+			continue
+		}
+
+		if level == 0 && c < len(s)-1 {
+			trim = false
+		}
+		
+		if s[c] == ')' {
+			level--
+
+			if level == 0 && c == len(s)-1 {
+				
+				var token string
+				
+				if trim {
+					token = s[1:len(s)-1]
+				} else {
+					token = s
+				}
+				return token
+			}
+		}
+	}
+	
+	return s
+}
+
+// ***************************************************************************
+// Key-Value storage
+// ***************************************************************************
+
+const KV_TEMP_PREFIX = ".tmp-"
+
+var kv_locks [64]sync.Mutex
+
+// ***************************************************************************
+
+type KeyValue struct {
+
+	K  string  `json:"_key"`
+	V  float64 `json:"value"`
+	T  int64   `json:"t,omitempty"`  // when last learned (ns), if it matters
+}
+
+// ***************************************************************************
+
+var ErrNotFinite = errors.New("not a finite number")
+
+// ***************************************************************************
+
+func AddKV(collname string,kv KeyValue) error {
+
+	// Inf and NaN can't be learned from, nor written as JSON
+
+	if !isFinite(kv.V) {
+		err := fmt.Errorf("%w: %s%s = %v",ErrNotFinite,collname,kv.K,kv.V)
+		fmt.Println("Unable to write promise",err)
+		return err
+	}
+
+	data, err := json.Marshal(kv)
+
+	if err == nil {
+		err = WriteKV(collname,kv.K,data)
+	}
+
+	if err != nil {
+		fmt.Println("Unable to write promise",kv,err)
+	}
+
+	return err
+}
+
+// ***************************************************************************
+
+func isFinite(x float64) bool {
+
+	return !math.IsInf(x,0) && !math.IsNaN(x)
+}
+
+// **************************************************
+
+func GetKV(collname,key string) KeyValue {
+
+	var kv KeyValue
+
+	data, err := os.ReadFile(KVPath(collname,key))
+
+	if err == nil {
+		json.Unmarshal(data,&kv)
+	}
+
+	kv.K = key
+	return kv
+}
+
+// **************************************************
+
+func KVPath(collname,key string) string {
+
+	// One directory per collection, one file per key. Keys are escaped
+	// so that any string (e.g. with /) is a single safe filename
+
+	return KVDIR+collname+"/"+url.PathEscape(key)
+}
+
+// **************************************************
+
+func WriteKV(collname,key string, data []byte) error {
+
+	// Write to a temporary file and rename it into place, so readers
+	// (in this process or another) never see a half written value
+
+	err := os.MkdirAll(KVDIR+collname, 0755)
+
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(KVDIR+collname,KV_TEMP_PREFIX+"*")
 
-	if s[0] != '(' {
-		return s
+	if err != nil {
+		return err
 	}
 
-	for c := 0; c < len(s); c++ {
+	_, err = f.Write(data)
 
-		if s[c] == '(' {
-			level++
-			continue
-		}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 
-		if level == 0 && c < len(s)-1 {
-			trim = false
-		}
-		
-		if s[c] == ')' {
-			level--
+	if err == nil {
+		err = os.Rename(f.Name(),KVPath(collname,key))
+	}
 
-			if level == 0 && c == len(s)-1 {
-				
-				var token string
-				
-				if trim {
-					token = s[1:len(s)-1]
-				} else {
-					token = s
-				}
-				return token
-			}
-		}
+	if err != nil {
+		os.Remove(f.Name())
 	}
-	
-	return s
+
+	return err
 }
 
-// ***************************************************************************
-// Key-Value storage
-// ***************************************************************************
+// **************************************************
 
-type KeyValue struct {
+func LockKV(collname,key string) func() {
 
-	K  string  `json:"_key"`
-	V  float64 `json:"value"`
+	// Serialize read-modify-write of one key within this process and
+	// return the unlock. Keys share a fixed set of mutexes, so never
+	// take a second key lock while holding one
+
+	h := fnv.New32a()
+	h.Write([]byte(filepath.Join(collname,key)))
+
+	m := &kv_locks[h.Sum32() % uint32(len(kv_locks))]
+	m.Lock()
+	return m.Unlock
 }
 
-// ***************************************************************************
+// **************************************************
 
-func AddKV(collname string,kv KeyValue) {
+func ListKV(collname string) []string {
 
-	if !IsDir(KVDIR) {
-		
-		os.MkdirAll(KVDIR, 0755)
-	}
+	// All keys stored in a collection, in sorted order
 
-	s := fmt.Sprintf("%+v",kv)
+	var keys []string
 
-	data := []byte(s)
-	err := os.WriteFile(KVDIR+collname+kv.K, data, 0644)
+	entries, err := os.ReadDir(KVDIR+collname)
 
 	if err != nil {
-		fmt.Println("Unable to write promise",kv,err)
-		os.Exit(-1)
+		return keys
+	}
+
+	for _, entry := range entries {
+
+		// Escaped keys never start with the temporary file prefix
+
+		if strings.HasPrefix(entry.Name(),KV_TEMP_PREFIX) {
+			continue
+		}
+
+		key, err := url.PathUnescape(entry.Name())
+
+		if err == nil && !entry.IsDir() {
+			keys = append(keys,key)
+		}
 	}
 
+	sort.Strings(keys)
+	return keys
 }
 
 // **************************************************
 
-func GetKV(collname,key string) KeyValue {
+func IncrementKV(collname,key string, by float64) KeyValue {
 
-	var kv KeyValue
+	// Read-modify-write a counter
 
-	b,_ := os.ReadFile(KVDIR+key)
+	unlock := LockKV(collname,key)
+	defer unlock()
 
-	fmt.Sscanf(string(b),"%f",&kv.V)
-	kv.K = key
-	kv.V = CONTEXT[key]
+	kv := GetKV(collname,key)
+	kv.V += by
+	AddKV(collname,kv)
 	return kv
 }
 
@@ -623,22 +1458,19 @@ func GetKV(collname,key string) KeyValue {
 // Promise tracking
 // **************************************************
 
-func AddPromiseHistory(collname, key string, e PromiseHistory) {
-
-	if !IsDir(KVDIR) {
-		
-		os.MkdirAll(KVDIR, 0755)
-	}
+func AddPromiseHistory(collname, key string, e PromiseHistory) error {
 
-	s := fmt.Sprintf("%+v",e)
+	data, err := json.Marshal(e)
 
-	data := []byte(s)
-	err := os.WriteFile(KVDIR+collname+key, data, 0644)
+	if err == nil {
+		err = WriteKV(collname,key,data)
+	}
 
 	if err != nil {
 		fmt.Println("Unable to write promise",key,err)
-		os.Exit(-1)
 	}
+
+	return err
 }
 
 // **************************************************
@@ -647,11 +1479,13 @@ func GetPromiseHistory(collname, key string) (bool,PromiseHistory) {
 
 	var v PromiseHistory
 
-	data,err := os.ReadFile(KVDIR+collname+key)
+	data,err := os.ReadFile(KVPath(collname,key))
 
-	fmt.Sscanf(string(data),"%+v",&v)
+	if err == nil {
+		err = json.Unmarshal(data,&v)
+	}
 
-	if err != nil {
+	if err == nil {
 		return true, v
 		
 	} else {
@@ -668,90 +1502,112 @@ func LearnUpdateKeyValue(collname,key string, now int64, q float64, units string
 
 	// now should be time.Now().UnixNano()
 
-	var e PromiseHistory
+	unlock := LockKV(collname,key)
+	defer unlock()
+
+	exists, previous := GetPromiseHistory(collname,key)
+
+	if !isFinite(q) {
+		fmt.Println("Rejected sample for",collname+key,q,ErrNotFinite)
+		return previous
+	}
 
+	e := UpdatePromiseHistory(previous,exists,now,q,units,GetLearningPolicy(collname))
 	e.PromiseId = key
 
+	AddPromiseHistory(collname,key,e)
+
+	return e
+}
+
+// **************************************************
+
+func UpdatePromiseHistory(previous PromiseHistory, exists bool, now int64, q float64, units string, policy LearningPolicy) PromiseHistory {
+
+	// Learn a new sample q at time now into the history, without storing it
+
+	var e PromiseHistory
+
+	e.PromiseId = previous.PromiseId
+	e.Q = q
+	e.Units = units
+
 	// Slide derivative window
 
 	// time is weird in go. Duration is basically int64 in nanoseconds
 
-	exists, previous := GetPromiseHistory(collname,key)
-	
 	if !exists {
 
 		// Initial bootstrap defaults
 
-		e.Q_av = 0.6 * float64(q)
+		e.Q_av = policy.Initial(q)
 		e.Q_var = 0
 
 		e.T = now
 		e.Dt_av = 0
 		e.Dt_var = 0
 
-		AddPromiseHistory(collname,key,e)
+		e.Sketch = NewQuantileSketch(SKETCH_ALPHA)
+		e.Sketch.Add(q)
 
 	} else {
 		e.Q2 = previous.Q1
 		e.Q1 = previous.Q
-		e.Q = q
 
-		e.Units = units
-
-		e.Q_av = 0.5 * previous.Q + 0.5 * float64(q)
-		dv2 := (e.Q-e.Q_av) * (e.Q-e.Q_av)
-		e.Q_var = 0.5 * e.Q_var + 0.5 * dv2
-		
 		e.T2 = previous.T1
 		e.T1 = previous.T
 		e.T = now
 
 		dt := float64(now-previous.T) // time difference now-previous
 
-		e.Dt_av = 0.5 * previous.Dt_av + 0.5 * dt
-		e.Dt_var = 0.5 * e.Q_var + 0.5 * (e.Dt_av-dt) * (e.Dt_av-dt)
+		e.Dt_av = policy.Learn(previous.Dt_av,dt,dt)
 
-		AddPromiseHistory(collname,key,e)
-	}
+		if policy.Blend == BLEND_AVERAGE {
 
-	return e
-}
+			e.Q_av = policy.Learn(previous.Q_av,q,dt)
+			dv2 := (e.Q-e.Q_av) * (e.Q-e.Q_av)
+			e.Q_var = policy.Learn(previous.Q_var,dv2,dt)
+			e.Dt_var = policy.Learn(previous.Dt_var,(e.Dt_av-dt) * (e.Dt_av-dt),dt)
 
-// ****************************************************************************
+		} else {
 
-func FirstDerivative(e PromiseHistory, qscale,tscale float64) float64 {
+			// The original rule, exactly: the average of the last two
+			// samples, and variances from the latest deviations only
 
-	dq := (e.Q - e.Q1)/qscale
-	dt := float64(e.T-e.T1)/tscale
+			e.Q_av = policy.Learn(previous.Q,q,dt)
+			dv2 := (e.Q-e.Q_av) * (e.Q-e.Q_av)
+			e.Q_var = policy.Learn(0,dv2,dt)
+			e.Dt_var = policy.Learn(e.Q_var,(e.Dt_av-dt) * (e.Dt_av-dt),dt)
+		}
 
-	if dt == 0 {
-		return 0
-	}
+		e.Sketch = previous.Sketch
 
-	dqdt := dq/dt
+		if e.Sketch == nil {
+			e.Sketch = NewQuantileSketch(SKETCH_ALPHA)
+		}
 
-	fmt.Println("Deriv dq/dt (latency)",dqdt)
+		e.Sketch.Add(q)
+	}
 
-	return dqdt
+	return e
 }
 
 // ****************************************************************************
 
-func SecondDerivative(e PromiseHistory, qscale,tscale float64) float64 {
+func FirstDerivative(e PromiseHistory, qscale,tscale float64) float64 {
 
-	dv := ((e.Q - e.Q1)/float64(e.T-e.T1) - (e.Q1 - e.Q2)/float64(e.T1-e.T2))/qscale*tscale
+	// See EstimateFirstDerivative for the uncertainty
 
-	dt := (e.Q1 *float64(e.T-e.T1)/tscale)
+	return EstimateFirstDerivative(e,qscale,tscale).Value
+}
 
-	d2qdt2 := dv/dt
+// ****************************************************************************
 
-	if dt == 0 {
-		return 0
-	}
+func SecondDerivative(e PromiseHistory, qscale,tscale float64) float64 {
 
-	fmt.Println("Deriv d2q/dt2 (latency)",d2qdt2)
+	// See EstimateSecondDerivative for the uncertainty
 
-	return d2qdt2
+	return EstimateSecondDerivative(e,qscale,tscale).Value
 }
 
 // ****************************************************************************
@@ -881,12 +1737,54 @@ func GetAllWeekMemory(collname string) []float64 {
 
 // ****************************************************************************
 
+func GetPromiseWeekMemory(name string) []float64 {
+
+	// The weekly periodogram learned by the promise wrappers for one
+	// promise, the running average of each name:timeslot history, in the
+	// same 5 min grains as GetAllWeekMemory. Unseen slots are 0
+
+	return getWeekMemory(PROMISE_COLLECTION,name)
+}
+
+// ****************************************************************************
+
+func GetObservedWeekMemory(name string) []float64 {
+
+	// The same, for a quantity learned by Observe or ObserveCounter
+
+	return getWeekMemory(OBSERVE_COLLECTION,name)
+}
+
+// ****************************************************************************
+
+func getWeekMemory(collname, name string) []float64 {
+
+	var now int64
+	var data []float64
+
+	name = PromiseName(name)
+
+	for now = CF_MONDAY_MORNING; now < CF_MONDAY_MORNING + SECONDS_PER_WEEK; now += CF_MEASURE_INTERVAL {
+
+		_, e := GetPromiseHistory(collname,name+":"+GetUnixTimeKey(now))
+		data = append(data,e.Q_av)
+	}
+
+	return data
+}
+
+// ****************************************************************************
+
 func SumWeeklyKV(collname string,t int64, value float64){
 
 	// Create a cumuluative weekly periodogram database KeyValue store
 	// the time t should be in time.Unix() second resolution
 
 	key := GetUnixTimeKey(t)
+
+	unlock := LockKV(collname,key)
+	defer unlock()
+
 	kv := GetKV(collname,key)
 	kv.K = key
 	kv.V = value + kv.V
@@ -901,9 +1799,29 @@ func LearnWeeklyKV(collname string,t int64, value float64){
 	// the time t should be in time.Unix() second resolution
 
 	key := GetUnixTimeKey(t)
+
+	unlock := LockKV(collname,key)
+	defer unlock()
+
 	kv := GetKV(collname,key)
 	kv.K = key
-	kv.V = 0.5 * value + 0.5 * kv.V
+
+	policy := GetWeeklyLearningPolicy(collname)
+	now := t * NANO
+
+	switch {
+
+	case kv.T == 0 && kv.V == 0:
+		kv.V = policy.Initial(value)
+
+	case kv.T == 0:
+		kv.V = policy.Learn(kv.V,value,-1) // no time recorded, use Alpha
+
+	default:
+		kv.V = policy.Learn(kv.V,value,float64(now-kv.T))
+	}
+
+	kv.T = now
 	AddKV(collname,kv)
 }
 
@@ -948,33 +1866,41 @@ const NEVER = 0
 
 type Lock struct {
 
-	Ready bool
-	This  string
-	Last  string
+	Ready  bool
+	This   string
+	Last   string
+	Reason string  // why the lock was not ready
 }
 
 // *****************************************************************
 
+var service_lock sync.Mutex  // check-then-acquire is one step within a process
+
+// *****************************************************************
+
 func BeginService(name string, ifelapsed,expireafter int64, now int64) Lock {
 
 	var lock Lock
 
+	service_lock.Lock()
+	defer service_lock.Unlock()
+
 	lock.Last = fmt.Sprintf("last.%s",name)
 	lock.This = fmt.Sprintf("lock.%s",name)
 	lock.Ready = true
 	
-	lastcompleted := GetLockTime(lock.Last)
+	lastcompleted := GetLockTime(LOCKDIR+lock.Last)
 
 	elapsedtime := (now - lastcompleted) / NANO // in seconds
 
 	if (elapsedtime < ifelapsed) {
 
-		fmt.Println("Too soon since last",lock.Last,elapsedtime,"/",ifelapsed)
+		lock.Reason = fmt.Sprintf("too soon since last (%d/%d s)",elapsedtime,ifelapsed)
 		lock.Ready = false
 		return lock
 	}
 
-	starttime := GetLockTime(lock.This)
+	starttime := GetLockTime(LOCKDIR+lock.This)
 
 	if (starttime == NEVER) {
 
@@ -993,10 +1919,24 @@ func BeginService(name string, ifelapsed,expireafter int64, now int64) Lock {
 			// For a read only server process, it's safe to continue
 
 			RemoveLock(lock.This)
+			ExpireLockHolder(lock.This)
+
+		} else {
+
+			lock.Reason = fmt.Sprintf("already running (%d/%d s)",runtime,expireafter)
+			lock.Ready = false
+			return lock
 		}
 	}
 
-	AcquireLock(lock.This)
+	// Between processes, only one can create the lock file
+
+	if !TryAcquireLock(lock.This) {
+
+		lock.Reason = "already running (lock taken)"
+		lock.Ready = false
+	}
+
 	return lock
 }
 
@@ -1004,11 +1944,93 @@ func BeginService(name string, ifelapsed,expireafter int64, now int64) Lock {
 
 func EndService(lock Lock) {
 
+	service_lock.Lock()
+	defer service_lock.Unlock()
+
 	RemoveLock(lock.This)
 	RemoveLock(lock.Last)
 	AcquireLock(lock.Last)
 }
 
+// *****************************************************************
+// In-process lock holders, so that a forced lock can signal its owner
+// *****************************************************************
+
+var ErrLockExpired = errors.New("promise lock expired")
+var ErrPromiseDenied = errors.New("promise denied")
+
+// *****************************************************************
+
+type DeniedError struct {
+
+	Name   string
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+
+	return fmt.Sprintf("promise %q denied: %s",e.Name,e.Reason)
+}
+
+func (e *DeniedError) Unwrap() error {
+
+	return ErrPromiseDenied
+}
+
+type LockHolder struct {
+
+	cancel context.CancelCauseFunc
+	stop   context.CancelFunc
+}
+
+var holder_lock sync.Mutex
+var holders = make(map[string]*LockHolder)
+
+// *****************************************************************
+
+func RegisterLockHolder(lockname string, h *LockHolder) {
+
+	holder_lock.Lock()
+	holders[lockname] = h
+	holder_lock.Unlock()
+}
+
+// *****************************************************************
+
+func ReleaseLockHolder(lockname string, h *LockHolder) {
+
+	// Only forget the holder if it is still ours, the lock may have
+	// been forced and taken over by someone else in the meantime
+
+	holder_lock.Lock()
+
+	if holders[lockname] == h {
+		delete(holders,lockname)
+	}
+
+	holder_lock.Unlock()
+
+	h.stop()
+	h.cancel(nil)
+}
+
+// *****************************************************************
+
+func ExpireLockHolder(lockname string) {
+
+	// Ask the current holder of a forced lock, if it lives in this
+	// process, to give up. Holders in other processes can't be reached
+
+	holder_lock.Lock()
+	h, ok := holders[lockname]
+	delete(holders,lockname)
+	holder_lock.Unlock()
+
+	if ok {
+		h.cancel(ErrLockExpired)
+	}
+}
+
 // *****************************************************************
 
 func GetLockTime(filename string) int64 {
@@ -1050,6 +2072,27 @@ func AcquireLock(name string) {
 
 // *****************************************************************
 
+func TryAcquireLock(name string) bool {
+
+	// Create the lock only if nobody else has, atomically
+
+	if !IsDir(LOCKDIR) {
+		
+		os.MkdirAll(LOCKDIR, 0755)
+	}
+
+	f, err := os.OpenFile(LOCKDIR+name,os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return false
+	}
+
+	f.Close()
+	return true
+}
+
+// *****************************************************************
+
 func RemoveLock(name string) {
 
 	err := os.Remove(LOCKDIR+name)
@@ -1094,6 +2137,68 @@ func KeyName(s string,n int) string {
 
 //**************************************************************
 
+func PromiseName(s string) string {
+
+	// Canonical promise names are KeyName()s, a '/' is no different from
+	// any other punctuation, e.g. "GET /items/{id}"
+
+	return KeyName(s,0)
+}
+
+//**************************************************************
+
+func PromisePath(s string) string {
+
+	// The path of a nested promise, e.g. deploy/fetch. The first part is
+	// the parent's PromiseName(), the children's names are kept distinct
+	// however long. Only child promises and their rollup use paths
+
+	parts := strings.Split(strings.TrimSpace(s),"/")
+
+	for i := range parts {
+		if i == 0 {
+			parts[i] = PromiseName(parts[i])
+		} else {
+			parts[i] = HashedKeyName(parts[i])
+		}
+	}
+
+	return strings.Join(parts,"/")
+}
+
+//**************************************************************
+
+func PromiseKey(s string) string {
+
+	// Keys of child promises are their paths, as BeginChild made them,
+	// any other name is flat, e.g. "GET /items/{id}"
+
+	if strings.Contains(s,"/") && PromisePath(s) == s {
+		return s
+	}
+
+	return PromiseName(s)
+}
+
+//**************************************************************
+
+func HashedKeyName(s string) string {
+
+	// KeyName() cuts names at 40 characters, so a longer name ends in
+	// a hash of the whole, else names with the same start would collide
+
+	if len(s) <= 40 {
+		return KeyName(s,0)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(s))
+
+	return KeyName(fmt.Sprintf("%s %08x",s[:31],h.Sum32()),0)
+}
+
+//**************************************************************
+
 func CanonifyName(s string) string {
 
 	return KeyName(s,0)
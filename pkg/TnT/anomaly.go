@@ -0,0 +1,167 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Anomalies - samples far from what a promise usually does raise context
+//* classes, so that policy expressions can react to instrumentation
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************
+
+const EVENT_ANOMALY = "anomaly"  // a sample was far outside its learned range
+
+// ***************************************************************************
+
+type AnomalyPolicy struct {
+
+	Sigmas     float64  // how far from the expected value is anomalous, 0 = off
+	Weekly     bool     // compare with the same DoughNowt slot, not all time
+	MinSamples float64  // learn this many samples before judging any
+}
+
+var DEFAULT_ANOMALY_POLICY = AnomalyPolicy{ Sigmas: 3, MinSamples: 5 }
+
+var anomaly_lock sync.RWMutex
+var anomaly_policy = DEFAULT_ANOMALY_POLICY
+
+// ***************************************************************************
+
+func SetAnomalyPolicy(p AnomalyPolicy) {
+
+	anomaly_lock.Lock()
+	anomaly_policy = p
+	anomaly_lock.Unlock()
+}
+
+// ***************************************************************************
+
+func GetAnomalyPolicy() AnomalyPolicy {
+
+	anomaly_lock.RLock()
+	defer anomaly_lock.RUnlock()
+	return anomaly_policy
+}
+
+// ***************************************************************************
+
+func AnomalyContextName(quantity, name string) string {
+
+	// e.g. latency_anomalous_deploy_fetch, a plain identifier that can be
+	// used in context expressions. Without a quantity, anomalous_<name>
+
+	r := strings.NewReplacer("-","_","/","_",".","_",":","_")
+
+	if quantity == "" {
+		return "anomalous_"+r.Replace(PromiseName(name))
+	}
+
+	return quantity+"_anomalous_"+r.Replace(PromiseName(name))
+}
+
+// ***************************************************************************
+
+func AnomalyScore(expected PromiseHistory, exists bool, q float64, min_samples float64) (float64,bool) {
+
+	// The z score of the sample q against a history learned before it.
+	// Too short or too steady a history can't tell us what is unusual
+
+	if !exists || expected.Sketch == nil || expected.Sketch.Count < min_samples {
+		return 0, false
+	}
+
+	sigma := math.Sqrt(expected.Q_var)
+
+	if sigma == 0 {
+		return 0, false
+	}
+
+	return (q - expected.Q_av) / sigma, true
+}
+
+// ***************************************************************************
+
+func DetectAnomaly(quantity, name string, expected PromiseHistory, exists bool, q float64, now time.Time) bool {
+
+	// Set the anomaly class with the confidence that the deviation is
+	// not chance, erf(|z|/sqrt 2), or withdraw it when q is back to normal
+
+	policy := GetAnomalyPolicy()
+
+	if policy.Sigmas <= 0 {
+		return false
+	}
+
+	z, ok := AnomalyScore(expected,exists,q,policy.MinSamples)
+
+	if !ok {
+		return false
+	}
+
+	class := AnomalyContextName(quantity,name)
+
+	if math.Abs(z) < policy.Sigmas {
+
+		if Confidence(class) > 0 {
+			SetContext(class,0)
+		}
+
+		return false
+	}
+
+	confidence := math.Erf(math.Abs(z)/math.Sqrt2)
+
+	SetContext(class,confidence)
+
+	var event PromiseEvent
+
+	event.Kind = EVENT_ANOMALY
+	event.Name = PromiseName(name)
+	event.Key = class
+	event.Time = now
+	event.Ready = true
+	event.Value = q
+	event.Q_av = expected.Q_av
+	event.Z = z
+	event.Level = confidence
+
+	EmitPromiseEvent(event)
+
+	return true
+}
+
+// ***************************************************************************
+
+func AnomalyBaselineKey(name, timeslot string) string {
+
+	// Which history a new sample of the named promise is judged against
+
+	if GetAnomalyPolicy().Weekly {
+		return name+":"+timeslot
+	}
+
+	return name
+}
@@ -0,0 +1,315 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Assessors - different notions of a promise kept, selectable per promise
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// ***************************************************************************
+
+const RELIABILITY_MEMORY = 0.4   // share of the old reliability kept per assessment
+const BETA_COLLECTION = "PromiseKeepingBeta"
+
+// ***************************************************************************
+
+type Assessment struct {
+
+	Level       float64   // how well this sample kept the promise, 0 to 1
+	LevelSigma  float64   // uncertainty in the level, if known
+	Dqdt        Estimate
+	D2qdt2      Estimate
+	Delta       float64   // what was learned into the reliability
+	Previous    float64   // reliability before
+	Reliability float64   // reliability after, also stored in PromiseKeeping
+	Notes       []string
+}
+
+// ***************************************************************************
+
+type Assessor interface {
+
+	// Judge the latest sample of a history against a promised upper bound
+	// (s) and learn the running reliability in PromiseKeeping[e.PromiseId]
+
+	Assess(e PromiseHistory, assessed_quality,promise_upper_bound,trust_interval float64) Assessment
+}
+
+// ***************************************************************************
+
+var assessor_lock sync.RWMutex
+var assessor_default Assessor = LogisticAssessor{}
+var assessors = make(map[string]Assessor)
+
+// ***************************************************************************
+
+func SetAssessor(pattern string, a Assessor) {
+
+	// Select how promises matching a name or * pattern are assessed.
+	// The exact name wins, then the most specific pattern. nil removes it
+
+	key := CanonifyPattern(pattern)
+
+	assessor_lock.Lock()
+	defer assessor_lock.Unlock()
+
+	if a == nil {
+		delete(assessors,key)
+	} else {
+		assessors[key] = a
+	}
+}
+
+// ***************************************************************************
+
+func SetDefaultAssessor(a Assessor) {
+
+	if a == nil {
+		a = LogisticAssessor{}
+	}
+
+	assessor_lock.Lock()
+	assessor_default = a
+	assessor_lock.Unlock()
+}
+
+// ***************************************************************************
+
+func ResetAssessors() {
+
+	assessor_lock.Lock()
+	assessor_default = LogisticAssessor{}
+	assessors = make(map[string]Assessor)
+	assessor_lock.Unlock()
+}
+
+// ***************************************************************************
+
+func GetAssessor(name string) Assessor {
+
+	// The name may be a history key, name:timeslot
+
+	name, _, _ = strings.Cut(name,":")
+	key := PromiseName(name)
+
+	assessor_lock.RLock()
+	defer assessor_lock.RUnlock()
+
+	if a, ok := assessors[key]; ok {
+		return a
+	}
+
+	var patterns []string
+
+	for pattern := range assessors {
+		if strings.Contains(pattern,"*") {
+			patterns = append(patterns,pattern)
+		}
+	}
+
+	if pattern, ok := MostSpecificPattern(patterns,key); ok {
+		return assessors[pattern]
+	}
+
+	return assessor_default
+}
+
+// ***************************************************************************
+// The original kinetic trust assessment, the default
+// ***************************************************************************
+
+type LogisticAssessor struct {
+
+	Slope        float64  // steepness of the logistic at the bound, 0 means 3
+	NoisePenalty float64  // divide the level when sigma exceeds the mean, 0 means 1.5
+	Step         float64  // reward or penalty for a significant trend, 0 means 0.1
+	Memory       float64  // share of the old reliability kept, 0 means RELIABILITY_MEMORY
+}
+
+// ***************************************************************************
+
+func (l LogisticAssessor) defaults() LogisticAssessor {
+
+	if l.Slope == 0 {
+		l.Slope = 3
+	}
+
+	if l.NoisePenalty == 0 {
+		l.NoisePenalty = 1.5
+	}
+
+	if l.Step == 0 {
+		l.Step = 0.1
+	}
+
+	if l.Memory == 0 {
+		l.Memory = RELIABILITY_MEMORY
+	}
+
+	return l
+}
+
+// ***************************************************************************
+// Kept if within the bound, else not
+// ***************************************************************************
+
+type ThresholdAssessor struct {
+
+	Memory float64  // 0 means RELIABILITY_MEMORY
+}
+
+// ***************************************************************************
+
+func (t ThresholdAssessor) Assess(e PromiseHistory, assessed_quality,promise_upper_bound,trust_interval float64) Assessment {
+
+	var a Assessment
+
+	if e.Q <= promise_upper_bound * NANO {
+		a.Level = 1
+	} else {
+		a.Notes = append(a.Notes,fmt.Sprintf("Bound %v s exceeded",promise_upper_bound))
+	}
+
+	a.Delta = a.Level * assessed_quality
+	a.Previous, a.Reliability = BlendReliability(e.PromiseId,a.Delta,memoryOr(t.Memory))
+
+	return a
+}
+
+// ***************************************************************************
+// Fully kept up to the bound, then less and less
+// ***************************************************************************
+
+type LinearRampAssessor struct {
+
+	Width  float64  // how far past the bound, as a fraction of it, the level reaches 0. 0 means 1
+	Memory float64  // 0 means RELIABILITY_MEMORY
+}
+
+// ***************************************************************************
+
+func (r LinearRampAssessor) Assess(e PromiseHistory, assessed_quality,promise_upper_bound,trust_interval float64) Assessment {
+
+	var a Assessment
+
+	width := r.Width
+
+	if width == 0 {
+		width = 1
+	}
+
+	bound := promise_upper_bound * NANO
+
+	if width * bound <= 0 {
+
+		// No ramp to go down, so kept or not
+
+		if e.Q <= bound {
+			a.Level = 1
+		}
+
+	} else {
+		a.Level = 1 - (e.Q - bound) / (width * bound)
+		a.Level = math.Max(0,math.Min(1,a.Level))
+	}
+
+	a.Delta = a.Level * assessed_quality
+	a.Previous, a.Reliability = BlendReliability(e.PromiseId,a.Delta,memoryOr(r.Memory))
+
+	return a
+}
+
+// ***************************************************************************
+// Counting kept and broken promises, the reliability is the Beta posterior mean
+// ***************************************************************************
+
+type BetaAssessor struct {
+
+	Prior  float64  // pseudo-counts of kept and of not kept to begin with, 0 means 1
+	Forget float64  // fraction of the counts forgotten per assessment, 0 never forgets
+}
+
+// ***************************************************************************
+
+func (b BetaAssessor) Assess(e PromiseHistory, assessed_quality,promise_upper_bound,trust_interval float64) Assessment {
+
+	// Each assessment is a Bernoulli trial, kept with the assessed quality
+	// if within the bound. The counts are kept in BETA_COLLECTION
+
+	var a Assessment
+
+	prior := b.Prior
+
+	if prior == 0 {
+		prior = 1
+	}
+
+	if e.Q <= promise_upper_bound * NANO {
+		a.Level = 1
+	}
+
+	a.Delta = a.Level * assessed_quality
+
+	key := e.PromiseId
+
+	unlock := LockKV("PromiseKeeping",key)
+	defer unlock()
+
+	kept := GetKV(BETA_COLLECTION,key+".kept")
+	notkept := GetKV(BETA_COLLECTION,key+".notkept")
+
+	if kept.V == 0 && notkept.V == 0 {
+		kept.V, notkept.V = prior, prior
+	}
+
+	a.Previous = kept.V / (kept.V + notkept.V)
+
+	kept.V = kept.V * (1 - b.Forget) + a.Delta
+	notkept.V = notkept.V * (1 - b.Forget) + (1 - a.Delta)
+
+	n := kept.V + notkept.V
+
+	a.Reliability = kept.V / n
+	a.LevelSigma = math.Sqrt(kept.V * notkept.V / (n * n * (n + 1)))
+	a.Notes = append(a.Notes,fmt.Sprintf("Beta(%.3g,%.3g) sd %.3g",kept.V,notkept.V,a.LevelSigma))
+
+	AddKV(BETA_COLLECTION,kept)
+	AddKV(BETA_COLLECTION,notkept)
+	AddKV("PromiseKeeping",KeyValue{ K: key, V: a.Reliability })
+
+	return a
+}
+
+// ***************************************************************************
+
+func memoryOr(memory float64) float64 {
+
+	if memory == 0 {
+		return RELIABILITY_MEMORY
+	}
+
+	return memory
+}
@@ -0,0 +1,576 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Context expressions - parsed once into a tree, evaluated many times
+//*
+//*   expr    := and { '|' and }          runs of | are one OR
+//*   and     := unary { '&' unary }      runs of & and . are one AND
+//*   unary   := '!' unary | primary
+//*   primary := identifier | '(' expr ')'
+//*
+//*   AND, OR and NOT are computed by an Algebra, the product by default
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// ***************************************************************************
+
+const (
+	EXPR_CLASS = iota  // a context identifier
+	EXPR_NOT
+	EXPR_AND
+	EXPR_OR
+)
+
+// ***************************************************************************
+
+type Expr struct {
+
+	Op   int
+	Name string   // for EXPR_CLASS
+	Args []*Expr  // one for EXPR_NOT, two or more for EXPR_AND, EXPR_OR
+}
+
+// ***************************************************************************
+
+func Compile(s string) (*Expr, error) {
+
+	// Parse a quasi-Boolean context expression, e.g. "(a | b) & !c"
+
+	p := exprParser{ src: s, tokens: tokenizeExpr(s) }
+
+	x, err := p.parseOr()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != TOKEN_END {
+		return nil, p.fail(`an operator "|" or "&" or the end`,t)
+	}
+
+	return x, nil
+}
+
+// ***************************************************************************
+
+func MustCompile(s string) *Expr {
+
+	x, err := Compile(s)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return x
+}
+
+// ***************************************************************************
+
+func (x *Expr) Eval(value func(name string) float64) float64 {
+
+	// The same algebra as ever: AND is the product of confidences, OR is
+	// the probabilistic sum A + B - AB, NOT is crisp (anything > 0 is true)
+
+	return x.EvalWith(value,PRODUCT_ALGEBRA)
+}
+
+// ***************************************************************************
+
+func (x *Expr) EvalWith(value func(name string) float64, a Algebra) float64 {
+
+	// Evaluate with a chosen t-norm for AND and t-conorm for OR. Runs of
+	// AND and OR are folded left from their identities, 1 and 0
+
+	a = a.defaults()
+
+	switch x.Op {
+
+	case EXPR_CLASS:
+		return value(x.Name)
+
+	case EXPR_NOT:
+		return a.Not(x.Args[0].EvalWith(value,a))
+
+	case EXPR_AND:
+		result := 1.0
+		for _, arg := range x.Args {
+			result = a.And(result,arg.EvalWith(value,a))
+		}
+		return result
+
+	case EXPR_OR:
+		result := 0.0
+		for _, arg := range x.Args {
+			result = a.Or(result,arg.EvalWith(value,a))
+		}
+		return result
+	}
+
+	return 0
+}
+
+// ***************************************************************************
+
+func (x *Expr) Classes() []string {
+
+	// The identifiers the expression depends on, in order of appearance
+
+	var names []string
+	seen := make(map[string]bool)
+
+	var walk func(x *Expr)
+
+	walk = func(x *Expr) {
+
+		if x.Op == EXPR_CLASS && !seen[x.Name] {
+			seen[x.Name] = true
+			names = append(names,x.Name)
+		}
+
+		for _, a := range x.Args {
+			walk(a)
+		}
+	}
+
+	walk(x)
+	return names
+}
+
+// ***************************************************************************
+
+func (x *Expr) String() string {
+
+	// A canonical form, with . for AND as CleanExpression writes it
+
+	switch x.Op {
+
+	case EXPR_CLASS:
+		return x.Name
+
+	case EXPR_NOT:
+		if x.Args[0].Op == EXPR_CLASS || x.Args[0].Op == EXPR_NOT {
+			return "!"+x.Args[0].String()
+		}
+		return "!("+x.Args[0].String()+")"
+
+	case EXPR_AND:
+		parts := make([]string,len(x.Args))
+		for i, a := range x.Args {
+			if a.Op == EXPR_OR {
+				parts[i] = "("+a.String()+")"
+			} else {
+				parts[i] = a.String()
+			}
+		}
+		return strings.Join(parts,".")
+
+	case EXPR_OR:
+		parts := make([]string,len(x.Args))
+		for i, a := range x.Args {
+			parts[i] = a.String()
+		}
+		return strings.Join(parts,"|")
+	}
+
+	return ""
+}
+
+// ***************************************************************************
+// Algebras - how confidences combine under AND, OR and NOT
+// ***************************************************************************
+
+type Algebra struct {
+
+	Name string
+	And  func(a, b float64) float64  // a t-norm, nil means the product
+	Or   func(a, b float64) float64  // its t-conorm, nil means A + B - AB
+	Not  func(a float64) float64     // nil means crisp, 1 if a is 0, else 0
+}
+
+// ***************************************************************************
+
+var PRODUCT_ALGEBRA = Algebra{
+
+	// The original, and the default
+
+	Name: "product",
+	And: func(a, b float64) float64 { return a * b },
+	Or: func(a, b float64) float64 { return a + b - a * b },
+}
+
+var ZADEH_ALGEBRA = Algebra{
+
+	// Idempotent: a & a is a, a | a is a
+
+	Name: "zadeh",
+	And: math.Min,
+	Or: math.Max,
+	Not: func(a float64) float64 { return 1 - a },
+}
+
+var LUKASIEWICZ_ALGEBRA = Algebra{
+
+	// Bounded: weak evidence adds up to nothing under AND, strong
+	// evidence saturates at 1 under OR
+
+	Name: "lukasiewicz",
+	And: func(a, b float64) float64 { return math.Max(0,a + b - 1) },
+	Or: func(a, b float64) float64 { return math.Min(1,a + b) },
+	Not: func(a float64) float64 { return 1 - a },
+}
+
+// ***************************************************************************
+
+func AlgebraByName(name string) (Algebra,bool) {
+
+	// Look up a built in algebra, e.g. from a configuration file
+
+	switch strings.ToLower(name) {
+
+	case "", "product", "probabilistic":
+		return PRODUCT_ALGEBRA, true
+	case "zadeh", "minmax", "min/max":
+		return ZADEH_ALGEBRA, true
+	case "lukasiewicz", "łukasiewicz":
+		return LUKASIEWICZ_ALGEBRA, true
+	}
+
+	return PRODUCT_ALGEBRA, false
+}
+
+// ***************************************************************************
+
+func (a Algebra) defaults() Algebra {
+
+	if a.And == nil {
+		a.And = PRODUCT_ALGEBRA.And
+	}
+
+	if a.Or == nil {
+		a.Or = PRODUCT_ALGEBRA.Or
+	}
+
+	if a.Not == nil {
+		a.Not = crispNot
+	}
+
+	return a
+}
+
+// ***************************************************************************
+
+func crispNot(a float64) float64 {
+
+	if a > 0 {
+		return 0
+	}
+
+	return 1
+}
+
+// ***************************************************************************
+// Tokens
+// ***************************************************************************
+
+const (
+	TOKEN_END = iota
+	TOKEN_CLASS
+	TOKEN_AND
+	TOKEN_OR
+	TOKEN_NOT
+	TOKEN_LPAREN
+	TOKEN_RPAREN
+)
+
+type exprToken struct {
+
+	kind   int
+	text   string
+	column int  // 1-based, in runes
+}
+
+// ***************************************************************************
+
+func (t exprToken) String() string {
+
+	if t.kind == TOKEN_END {
+		return "end of expression"
+	}
+
+	return fmt.Sprintf("%q",t.text)
+}
+
+// ***************************************************************************
+
+func isExprOperator(r rune) bool {
+
+	return strings.ContainsRune("|&.!()",r)
+}
+
+// ***************************************************************************
+
+func tokenizeExpr(s string) []exprToken {
+
+	var tokens []exprToken
+
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); {
+
+		r := runes[i]
+		start := i
+
+		switch {
+
+		case unicode.IsSpace(r):
+			i++
+			continue
+
+		case r == '|':
+			for i < len(runes) && runes[i] == '|' {
+				i++
+			}
+			tokens = append(tokens,exprToken{ TOKEN_OR, string(runes[start:i]), start+1 })
+
+		case r == '&' || r == '.':
+			for i < len(runes) && (runes[i] == '&' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens,exprToken{ TOKEN_AND, string(runes[start:i]), start+1 })
+
+		case r == '!':
+			i++
+			tokens = append(tokens,exprToken{ TOKEN_NOT, "!", start+1 })
+
+		case r == '(':
+			i++
+			tokens = append(tokens,exprToken{ TOKEN_LPAREN, "(", start+1 })
+
+		case r == ')':
+			i++
+			tokens = append(tokens,exprToken{ TOKEN_RPAREN, ")", start+1 })
+
+		default:
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !isExprOperator(runes[i]) {
+				i++
+			}
+			tokens = append(tokens,exprToken{ TOKEN_CLASS, string(runes[start:i]), start+1 })
+		}
+	}
+
+	return append(tokens,exprToken{ TOKEN_END, "", len(runes)+1 })
+}
+
+// ***************************************************************************
+// Recursive descent
+// ***************************************************************************
+
+type exprParser struct {
+
+	src    string
+	tokens []exprToken
+	pos    int
+}
+
+// ***************************************************************************
+
+func (p *exprParser) peek() exprToken {
+
+	return p.tokens[p.pos]
+}
+
+// ***************************************************************************
+
+func (p *exprParser) next() exprToken {
+
+	t := p.tokens[p.pos]
+
+	if t.kind != TOKEN_END {
+		p.pos++
+	}
+
+	return t
+}
+
+// ***************************************************************************
+
+func (p *exprParser) fail(expected string, found exprToken) error {
+
+	return &ExprError{
+		Expr: p.src,
+		Column: found.column,
+		Expected: expected,
+		Found: found.String(),
+		Snippet: exprSnippet(p.src,found.column),
+	}
+}
+
+// ***************************************************************************
+
+func (p *exprParser) parseOr() (*Expr, error) {
+
+	x, err := p.parseAnd()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != TOKEN_OR {
+		return x, nil
+	}
+
+	or := &Expr{ Op: EXPR_OR, Args: []*Expr{ x } }
+
+	for p.peek().kind == TOKEN_OR {
+
+		p.next()
+		y, err := p.parseAnd()
+
+		if err != nil {
+			return nil, err
+		}
+
+		or.Args = append(or.Args,y)
+	}
+
+	return or, nil
+}
+
+// ***************************************************************************
+
+func (p *exprParser) parseAnd() (*Expr, error) {
+
+	x, err := p.parseUnary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != TOKEN_AND {
+		return x, nil
+	}
+
+	and := &Expr{ Op: EXPR_AND, Args: []*Expr{ x } }
+
+	for p.peek().kind == TOKEN_AND {
+
+		p.next()
+		y, err := p.parseUnary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		and.Args = append(and.Args,y)
+	}
+
+	return and, nil
+}
+
+// ***************************************************************************
+
+func (p *exprParser) parseUnary() (*Expr, error) {
+
+	if p.peek().kind == TOKEN_NOT {
+
+		p.next()
+		x, err := p.parseUnary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &Expr{ Op: EXPR_NOT, Args: []*Expr{ x } }, nil
+	}
+
+	return p.parsePrimary()
+}
+
+// ***************************************************************************
+
+func (p *exprParser) parsePrimary() (*Expr, error) {
+
+	t := p.next()
+
+	switch t.kind {
+
+	case TOKEN_CLASS:
+		return &Expr{ Op: EXPR_CLASS, Name: t.text }, nil
+
+	case TOKEN_LPAREN:
+
+		x, err := p.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c := p.next(); c.kind != TOKEN_RPAREN {
+			return nil, p.fail(fmt.Sprintf(`")" to close the "(" at column %d`,t.column),c)
+		}
+
+		return x, nil
+	}
+
+	return nil, p.fail(`an identifier, "!" or "("`,t)
+}
+
+// ***************************************************************************
+// Errors
+// ***************************************************************************
+
+type ExprError struct {
+
+	Expr     string  // the whole expression
+	Column   int     // where it went wrong, 1-based, in characters
+	Expected string  // what the grammar wanted there
+	Found    string  // what was there instead
+	Snippet  string  // the expression, with a ^ under the column on the next line
+}
+
+// ***************************************************************************
+
+func (e *ExprError) Error() string {
+
+	return fmt.Sprintf("context expression %q, column %d: expected %s, found %s",e.Expr,e.Column,e.Expected,e.Found)
+}
+
+// ***************************************************************************
+
+func exprSnippet(s string, column int) string {
+
+	// Tabs and newlines would put the caret in the wrong place
+
+	line := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return r
+	},s)
+
+	return line+"\n"+strings.Repeat(" ",column-1)+"^"
+}
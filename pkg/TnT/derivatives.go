@@ -0,0 +1,138 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Derivatives of irregularly sampled promise histories, with error bars
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"fmt"
+	"math"
+)
+
+// ***************************************************************************
+
+const SIGNIFICANCE = 2.0  // default z score for a change to count as real
+
+// ***************************************************************************
+
+type Estimate struct {
+
+	// A derived quantity with its one sigma uncertainty, propagated
+	// from the noise in the samples. Points = 0 means no estimate
+
+	Value  float64
+	Sigma  float64
+	Points int
+}
+
+// ***************************************************************************
+
+func (x Estimate) Significant(z float64) int {
+
+	// +1 or -1 if the value is more than z sigma from zero, else 0
+
+	if x.Points == 0 || math.Abs(x.Value) <= z * x.Sigma {
+		return 0
+	}
+
+	if x.Value > 0 {
+		return 1
+	}
+
+	return -1
+}
+
+// ***************************************************************************
+
+func (x Estimate) String() string {
+
+	return fmt.Sprintf("%g +- %g",x.Value,x.Sigma)
+}
+
+// ***************************************************************************
+
+func EstimateFirstDerivative(e PromiseHistory, qscale,tscale float64) Estimate {
+
+	// dq/dt at the newest sample. With three samples use the one-sided
+	// non-uniform stencil, which is second order even when the samples
+	// are unevenly spaced, else fall back to the two point difference
+
+	var x Estimate
+
+	sigma := math.Sqrt(e.Q_var)/qscale
+	q0, q1, q2 := e.Q/qscale, e.Q1/qscale, e.Q2/qscale
+
+	h1 := float64(e.T-e.T1)/tscale
+
+	if e.T1 == 0 || h1 <= 0 {
+		return x
+	}
+
+	h2 := float64(e.T1-e.T2)/tscale
+
+	if e.T2 == 0 || h2 <= 0 {
+
+		w0, w1 := 1/h1, -1/h1
+
+		x.Value = w0*q0 + w1*q1
+		x.Sigma = sigma * math.Sqrt(w0*w0 + w1*w1)
+		x.Points = 2
+		return x
+	}
+
+	w0 := (2*h1 + h2) / (h1 * (h1 + h2))
+	w1 := -(h1 + h2) / (h1 * h2)
+	w2 := h1 / (h2 * (h1 + h2))
+
+	x.Value = w0*q0 + w1*q1 + w2*q2
+	x.Sigma = sigma * math.Sqrt(w0*w0 + w1*w1 + w2*w2)
+	x.Points = 3
+	return x
+}
+
+// ***************************************************************************
+
+func EstimateSecondDerivative(e PromiseHistory, qscale,tscale float64) Estimate {
+
+	// d2q/dt2 over the last three samples, from the parabola through
+	// them, which allows for uneven spacing
+
+	var x Estimate
+
+	h1 := float64(e.T-e.T1)/tscale
+	h2 := float64(e.T1-e.T2)/tscale
+
+	if e.T1 == 0 || e.T2 == 0 || h1 <= 0 || h2 <= 0 {
+		return x
+	}
+
+	sigma := math.Sqrt(e.Q_var)/qscale
+	q0, q1, q2 := e.Q/qscale, e.Q1/qscale, e.Q2/qscale
+
+	w0 := 2 / (h1 * (h1 + h2))
+	w1 := -2 / (h1 * h2)
+	w2 := 2 / (h2 * (h1 + h2))
+
+	x.Value = w0*q0 + w1*q1 + w2*q2
+	x.Sigma = sigma * math.Sqrt(w0*w0 + w1*w1 + w2*w2)
+	x.Points = 3
+	return x
+}
@@ -0,0 +1,230 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* HTTP - serving requests as promises
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ***************************************************************************
+
+type PromiseHandler struct {
+
+	Next   http.Handler
+
+	// How to name the promise for a request. nil means the mux route
+	// pattern (when the handler is registered on an http.ServeMux),
+	// else the method and path, which may have many values
+
+	Namer  func(r *http.Request) string
+
+	// Take the BeginService lock and answer 429 Too Many Requests when
+	// it refuses. Otherwise requests may overlap and are only measured
+
+	Reject bool
+}
+
+// ***************************************************************************
+
+func PromiseMiddleware(next http.Handler) http.Handler {
+
+	return &PromiseHandler{ Next: next }
+}
+
+// ***************************************************************************
+
+func (h *PromiseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	name := h.RequestName(r)
+
+	var pctx PromiseContext
+
+	if h.Reject {
+
+		var err error
+
+		pctx, err = PromiseContext_TryBegin(name)
+
+		if err != nil {
+			PromiseContext_End(pctx)
+			RecordOutcome(name,PROMISE_SKIPPED)
+			CountHTTPStatus(name,http.StatusTooManyRequests)
+			http.Error(w,http.StatusText(http.StatusTooManyRequests),http.StatusTooManyRequests)
+			return
+		}
+
+	} else {
+		pctx = PromiseContext_BeginUnlocked(name)
+	}
+
+	// Join the client's trace, if it sent one, else any trace already in
+	// the request context. Promises the handler begins with the ...Context
+	// variants join ours
+
+	if sc, err := ParseTraceparent(r.Header.Get("traceparent")); err == nil {
+		pctx.JoinSpan(sc)
+	} else if sc, ok := SpanFromContext(r.Context()); ok {
+		pctx.JoinSpan(sc)
+	}
+
+	r = r.WithContext(ContextWithSpan(r.Context(),pctx.SpanContext()))
+
+	rec := &statusRecorder{ ResponseWriter: w }
+
+	// Close the promise even if the handler panics, the server recovers it
+
+	defer func() {
+
+		p := recover()
+		status := rec.status
+
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		if p != nil {
+			status = http.StatusInternalServerError
+		}
+
+		PromiseContext_EndQuality(pctx,OutcomeQuality(HTTPStatusOutcome(status)))
+		RecordHTTPStatus(name,status)
+
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	h.Next.ServeHTTP(rec,r)
+}
+
+// ***************************************************************************
+
+func (h *PromiseHandler) RequestName(r *http.Request) string {
+
+	// Routes often share their first 40 characters, so a longer name
+	// ends in a hash of the whole rather than being cut
+
+	name := r.Method+" "+r.URL.Path
+
+	if h.Namer != nil {
+		name = h.Namer(r)
+	} else if r.Pattern != "" {
+		name = r.Pattern
+	}
+
+	return HashedKeyName(name)
+}
+
+// ***************************************************************************
+
+func HTTPStatusClass(status int) string {
+
+	return fmt.Sprintf("http_%dxx",status/100)
+}
+
+// ***************************************************************************
+
+func HTTPStatusOutcome(status int) Outcome {
+
+	// The server keeps its promise unless it fails on its own account.
+	// A 4xx is the client's problem, the answer was still correct
+
+	if status >= 500 {
+		return PROMISE_NOT_KEPT
+	}
+
+	return PROMISE_KEPT
+}
+
+// ***************************************************************************
+
+func RecordHTTPStatus(name string, status int) {
+
+	// Count the status class (http_2xx etc.) next to the outcome counters
+
+	CountHTTPStatus(name,status)
+	RecordOutcome(name,HTTPStatusOutcome(status))
+}
+
+// ***************************************************************************
+
+func CountHTTPStatus(name string, status int) {
+
+	// Only the status class, for answers whose outcome is recorded
+	// otherwise, e.g. a 429 for a skipped promise
+
+	IncrementKV(PROMISE_COLLECTION,PromiseName(name)+"."+HTTPStatusClass(status),1)
+}
+
+// ***************************************************************************
+
+func GetHTTPStatusCounts(name string) map[string]float64 {
+
+	counts := make(map[string]float64)
+
+	for class := 1; class <= 5; class++ {
+		key := HTTPStatusClass(class*100)
+		counts[key] = GetKV(PROMISE_COLLECTION,PromiseName(name)+"."+key).V
+	}
+
+	return counts
+}
+
+// ***************************************************************************
+
+type statusRecorder struct {
+
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+
+	// Informational answers, e.g. 103 Early Hints, come before the
+	// final status. 101 Switching Protocols is final
+
+	informational := status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+
+	if rec.status == 0 && !informational {
+		rec.status = status
+	}
+
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+
+	// Lets http.ResponseController reach Flush etc. underneath
+
+	return rec.ResponseWriter
+}
@@ -0,0 +1,334 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Instrumentation sinks - where promise measurements are reported
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************
+
+const EVENT_END = "end"         // a promise context was closed and its history updated
+const EVENT_ASSESS = "assess"   // a promise outcome was assessed for reliability
+const EVENT_DENIED = "denied"   // the lock refused the promise, nothing was learned
+
+// ***************************************************************************
+
+type PromiseEvent struct {
+
+	Kind        string     `json:"kind"`
+	Name        string     `json:"name"`
+	Key         string     `json:"key"`
+	Time        time.Time  `json:"time"`
+	TraceID     string     `json:"trace_id,omitempty"`
+	SpanID      string     `json:"span_id,omitempty"`
+
+	// Lock status at the start of the promise
+
+	Lock        string     `json:"lock,omitempty"`
+	Ready       bool       `json:"lock_ready"`
+	Reason      string     `json:"reason,omitempty"`
+
+	// EVENT_END, all times in nanoseconds
+
+	Latency     float64    `json:"latency_ns"`
+	Q_av        float64    `json:"q_av"`
+	Delta       float64    `json:"delta_q"`
+	Derivative  float64    `json:"derivative"`
+	Dt          float64    `json:"dt_ns"`
+	Dtau        float64    `json:"dtau_ns"`
+	Dt_av       float64    `json:"dt_av_ns"`
+
+	// EVENT_ASSESS
+
+	Bound       float64    `json:"bound_s,omitempty"`
+	Interval    float64    `json:"interval_s,omitempty"`
+	Quality     float64    `json:"quality,omitempty"`
+	Level       float64    `json:"level,omitempty"`
+	LevelSigma  float64    `json:"level_sigma,omitempty"`
+	Dqdt        float64    `json:"dqdt,omitempty"`
+	DqdtSigma   float64    `json:"dqdt_sigma,omitempty"`
+	D2qdt2      float64    `json:"d2qdt2,omitempty"`
+	D2qdt2Sigma float64    `json:"d2qdt2_sigma,omitempty"`
+	Previous    float64    `json:"previous_reliability,omitempty"`
+	Reliability float64    `json:"reliability,omitempty"`
+	Notes       []string   `json:"notes,omitempty"`
+
+	// EVENT_OBSERVE and EVENT_ANOMALY, with Level the confidence set in the context
+
+	Value       float64    `json:"value,omitempty"`
+	Units       string     `json:"units,omitempty"`
+	Z           float64    `json:"z,omitempty"`
+
+	// EVENT_OUTCOME
+
+	Outcome     string     `json:"outcome,omitempty"`
+}
+
+// ***************************************************************************
+
+type InstrumentationSink interface {
+
+	Emit(e PromiseEvent)
+}
+
+// ***************************************************************************
+
+var sink_lock sync.RWMutex
+var sink InstrumentationSink = PrintSink{}
+
+// ***************************************************************************
+
+func SetInstrumentationSink(s InstrumentationSink) {
+
+	// Select where promise events go, nil silences them
+
+	if s == nil {
+		s = NullSink{}
+	}
+
+	sink_lock.Lock()
+	sink = s
+	sink_lock.Unlock()
+}
+
+// ***************************************************************************
+
+func GetInstrumentationSink() InstrumentationSink {
+
+	sink_lock.RLock()
+	defer sink_lock.RUnlock()
+	return sink
+}
+
+// ***************************************************************************
+
+func EmitPromiseEvent(e PromiseEvent) {
+
+	GetInstrumentationSink().Emit(e)
+}
+
+// ***************************************************************************
+// No-op
+// ***************************************************************************
+
+type NullSink struct{}
+
+func (NullSink) Emit(e PromiseEvent) {}
+
+// ***************************************************************************
+// Human readable dump to stdout (the original behaviour)
+// ***************************************************************************
+
+type PrintSink struct{}
+
+var print_lock sync.Mutex  // keep concurrent event blocks from interleaving
+
+func (PrintSink) Emit(e PromiseEvent) {
+
+	print_lock.Lock()
+	defer print_lock.Unlock()
+
+	switch e.Kind {
+
+	case EVENT_END:
+		fmt.Println("------- INSTRUMENTATION --------------")
+		fmt.Println("   Location:", e.Key)
+		fmt.Println("   Lock ready", e.Ready)
+		fmt.Println("   Promise duration b (ms)", e.Latency/MILLI)
+		fmt.Println("   Running average 50/50", e.Q_av/NANO)
+
+		fmt.Println("   Change in promise since last sample",e.Delta)
+		fmt.Println("   Promise derivative b/s", e.Derivative)
+		fmt.Println("")
+		fmt.Println("   Time since last sample (s) phase",e.Dt/NANO)
+		fmt.Println("   Time signal uncertainty dtau (s) group",e.Dtau/NANO)
+		fmt.Println("   Running average sampling interval",e.Dt_av/NANO)
+		fmt.Println("------- INSTRUMENTATION --------------")
+
+	case EVENT_ASSESS:
+		fmt.Println("Promise level",e.Level,"+-",e.LevelSigma,"raw",e.Latency/NANO,e.Bound)
+		fmt.Println("Assessing payload",e.Quality)
+		fmt.Println("Deriv dq/dt (latency)",e.Dqdt,"+-",e.DqdtSigma)
+		fmt.Println("Deriv d2q/dt2 (latency)",e.D2qdt2,"+-",e.D2qdt2Sigma)
+
+		for _, note := range e.Notes {
+			fmt.Println(note)
+		}
+
+		fmt.Println("Old ML running reliability(delta)",e.Previous)
+		fmt.Println("New ML running reliability(delta)",e.Reliability,e.Delta)
+
+	case EVENT_OUTCOME:
+		fmt.Println("Promise",e.Name,"outcome",e.Outcome)
+
+	case EVENT_DENIED:
+		fmt.Println("Promise",e.Name,"denied by",e.Lock,"-",e.Reason)
+
+	case EVENT_ANOMALY:
+		fmt.Println("Promise",e.Name,"anomalous",e.Value,"vs",e.Q_av,"z =",e.Z,"context",e.Key,e.Level)
+
+	case EVENT_OBSERVE:
+		fmt.Println("Observed",e.Name,e.Value,e.Units,"average",e.Q_av,"rate of change",e.Derivative,"/s")
+
+	default:
+		fmt.Printf("PROMISE %s %+v\n",e.Kind,e)
+	}
+}
+
+// ***************************************************************************
+// Structured logging
+// ***************************************************************************
+
+type SlogSink struct {
+
+	Logger *slog.Logger  // nil means slog.Default()
+}
+
+func (s SlogSink) Emit(e PromiseEvent) {
+
+	logger := s.Logger
+
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	attrs := []any{
+		slog.String("kind",e.Kind),
+		slog.String("name",e.Name),
+		slog.String("key",e.Key),
+		slog.Bool("lock_ready",e.Ready),
+		slog.Float64("latency_ns",e.Latency),
+	}
+
+	switch e.Kind {
+
+	case EVENT_END:
+		attrs = append(attrs,
+			slog.Float64("q_av",e.Q_av),
+			slog.Float64("delta_q",e.Delta),
+			slog.Float64("derivative",e.Derivative),
+			slog.Float64("dt_ns",e.Dt),
+			slog.Float64("dtau_ns",e.Dtau),
+			slog.Float64("dt_av_ns",e.Dt_av))
+
+	case EVENT_ASSESS:
+		attrs = append(attrs,
+			slog.Float64("bound_s",e.Bound),
+			slog.Float64("quality",e.Quality),
+			slog.Float64("level",e.Level),
+			slog.Float64("dqdt",e.Dqdt),
+			slog.Float64("dqdt_sigma",e.DqdtSigma),
+			slog.Float64("d2qdt2",e.D2qdt2),
+			slog.Float64("d2qdt2_sigma",e.D2qdt2Sigma),
+			slog.Float64("reliability",e.Reliability),
+			slog.Any("notes",e.Notes))
+
+	case EVENT_OUTCOME:
+		attrs = append(attrs,slog.String("outcome",e.Outcome))
+
+	case EVENT_DENIED:
+		attrs = append(attrs,slog.String("lock",e.Lock),slog.String("reason",e.Reason))
+
+	case EVENT_OBSERVE:
+		attrs = append(attrs,
+			slog.Float64("value",e.Value),
+			slog.String("units",e.Units),
+			slog.Float64("q_av",e.Q_av),
+			slog.Float64("derivative",e.Derivative))
+
+	case EVENT_ANOMALY:
+		attrs = append(attrs,
+			slog.Float64("value",e.Value),
+			slog.Float64("q_av",e.Q_av),
+			slog.Float64("z",e.Z),
+			slog.String("context",e.Key),
+			slog.Float64("confidence",e.Level))
+	}
+
+	logger.Info("promise",attrs...)
+}
+
+// ***************************************************************************
+// JSON lines appended to a file
+// ***************************************************************************
+
+type JSONSink struct {
+
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// ***************************************************************************
+
+func NewJSONSink(filename string) (*JSONSink, error) {
+
+	f, err := os.OpenFile(filename,os.O_CREATE|os.O_WRONLY|os.O_APPEND,0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONSink{ file: f, enc: json.NewEncoder(f) }, nil
+}
+
+// ***************************************************************************
+
+func (s *JSONSink) Emit(e PromiseEvent) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.enc == nil {
+		return
+	}
+
+	err := s.enc.Encode(e)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr,"Unable to write promise event",e.Key,err)
+	}
+}
+
+// ***************************************************************************
+
+func (s *JSONSink) Close() error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	s.enc = nil
+	return err
+}
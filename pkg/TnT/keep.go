@@ -0,0 +1,170 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Keeping promises - begin/end in one call, with CFEngine style outcomes
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ***************************************************************************
+
+type Outcome string
+
+const (
+	PROMISE_KEPT     Outcome = "kept"      // nothing needed doing, all was well
+	PROMISE_REPAIRED Outcome = "repaired"  // something was changed to keep the promise
+	PROMISE_NOT_KEPT Outcome = "notkept"   // the work failed or panicked
+	PROMISE_SKIPPED  Outcome = "skipped"   // the lock was not ready, nothing was tried
+)
+
+var OUTCOMES = []Outcome{ PROMISE_KEPT, PROMISE_REPAIRED, PROMISE_NOT_KEPT, PROMISE_SKIPPED }
+
+const EVENT_OUTCOME = "outcome"
+
+// Return this (or wrap it) from the work to say that the promise was
+// kept by making a change, rather than being kept already
+
+var ErrRepaired = errors.New("promise repaired")
+
+// ***************************************************************************
+
+func Keep(name string, fn func(ctx context.Context) error) (Outcome, error) {
+
+	return KeepContext(context.Background(),name,fn)
+}
+
+// ***************************************************************************
+
+func KeepContext(parent context.Context, name string, fn func(ctx context.Context) error) (Outcome, error) {
+
+	// Wrap the work fn in a promise context, respecting the lock, and
+	// record how it went next to the latency history
+
+	ctx, pctx := PromiseContext_BeginContext(parent,name)
+
+	// A refusal ends like any other, so sinks see it denied
+
+	if !pctx.Plock.Ready {
+		PromiseContext_End(pctx)
+		RecordOutcome(pctx.Name,PROMISE_SKIPPED)
+		return PROMISE_SKIPPED, nil
+	}
+
+	err := keepSafely(ctx,name,fn)
+
+	var outcome Outcome
+
+	switch {
+	case err == nil:
+		outcome = PROMISE_KEPT
+	case errors.Is(err,ErrRepaired):
+		outcome = PROMISE_REPAIRED
+		err = nil
+	default:
+		outcome = PROMISE_NOT_KEPT
+	}
+
+	PromiseContext_EndQuality(pctx,OutcomeQuality(outcome))
+	RecordOutcome(pctx.Name,outcome)
+
+	return outcome, err
+}
+
+// ***************************************************************************
+
+func keepSafely(ctx context.Context, name string, fn func(ctx context.Context) error) (err error) {
+
+	// A panic breaks the promise, it doesn't break the caller
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("promise %q panicked: %v",name,r)
+		}
+	}()
+
+	return fn(ctx)
+}
+
+// ***************************************************************************
+
+func OutcomeQuality(outcome Outcome) float64 {
+
+	// The payload quality of an outcome, for assessing declared promises.
+	// A repaired promise was kept in the end
+
+	switch outcome {
+	case PROMISE_KEPT, PROMISE_REPAIRED:
+		return 1
+	}
+
+	return 0
+}
+
+// ***************************************************************************
+
+func OutcomeKey(name string, outcome Outcome) string {
+
+	// Canonical names never contain '.', so this can't clash with a name
+
+	return PromiseName(name)+"."+string(outcome)
+}
+
+// ***************************************************************************
+
+func RecordOutcome(name string, outcome Outcome) {
+
+	// Count outcomes in the same collection as the latency history
+
+	key := OutcomeKey(name,outcome)
+
+	IncrementKV(PROMISE_COLLECTION,key,1)
+
+	var event PromiseEvent
+
+	event.Kind = EVENT_OUTCOME
+	event.Name = PromiseName(name)
+	event.Key = PROMISE_COLLECTION+":"+key
+	event.Time = time.Now()
+	event.Ready = outcome != PROMISE_SKIPPED
+	event.Outcome = string(outcome)
+
+	EmitPromiseEvent(event)
+}
+
+// ***************************************************************************
+
+func GetOutcomes(name string) map[Outcome]float64 {
+
+	// Return the counters for each outcome of the named promise
+
+	counts := make(map[Outcome]float64)
+
+	for _, o := range OUTCOMES {
+		counts[o] = GetKV(PROMISE_COLLECTION,OutcomeKey(name,o)).V
+	}
+
+	return counts
+}
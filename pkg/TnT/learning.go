@@ -0,0 +1,180 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Learning rates - how much a new sample moves the running averages
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"math"
+	"sync"
+)
+
+// ***************************************************************************
+
+const BOOTSTRAP_FRACTION = "fraction"  // start the average at a fraction of the first sample
+const BOOTSTRAP_FIRST = "first"        // start the average at the first sample
+const BOOTSTRAP_ZERO = "zero"          // start the average at zero and let it climb
+
+const BLEND_LAST_SAMPLE = "sample"     // blend a new sample with the last one, the original rule
+const BLEND_AVERAGE = "average"        // blend it with the running average, a moving average
+
+// ***************************************************************************
+
+type LearningPolicy struct {
+
+	// Weight of a new sample in the running averages, 0 < Alpha <= 1
+
+	Alpha           float64
+
+	// If positive (seconds), the weight depends on how long it has been
+	// since the last sample instead: old memory halves every HalfLife, so
+	// a sparse sample counts for more than one of a rapid burst
+
+	HalfLife        float64
+
+	Bootstrap       string
+	BootstrapFactor float64  // for BOOTSTRAP_FRACTION
+
+	// What Q_av blends a new sample with, "" means BLEND_LAST_SAMPLE as
+	// LearnUpdateKeyValue always has. The intervals are always averaged
+
+	Blend           string
+}
+
+// ***************************************************************************
+
+var DEFAULT_LEARNING_POLICY = LearningPolicy{
+
+	Alpha: 0.5,
+	Bootstrap: BOOTSTRAP_FRACTION,
+	BootstrapFactor: 0.6,
+}
+
+var DEFAULT_WEEKLY_LEARNING_POLICY = LearningPolicy{
+
+	// LearnWeeklyKV has always started at half the first value
+
+	Alpha: 0.5,
+	Bootstrap: BOOTSTRAP_FRACTION,
+	BootstrapFactor: 0.5,
+}
+
+var learning_lock sync.RWMutex
+var learning_policies = make(map[string]LearningPolicy)
+
+// ***************************************************************************
+
+func SetLearningPolicy(collname string, p LearningPolicy) {
+
+	learning_lock.Lock()
+	learning_policies[collname] = p
+	learning_lock.Unlock()
+}
+
+// ***************************************************************************
+
+func GetLearningPolicy(collname string) LearningPolicy {
+
+	learning_lock.RLock()
+	defer learning_lock.RUnlock()
+
+	if p, ok := learning_policies[collname]; ok {
+		return p
+	}
+
+	return DEFAULT_LEARNING_POLICY
+}
+
+// ***************************************************************************
+
+func GetWeeklyLearningPolicy(collname string) LearningPolicy {
+
+	// As GetLearningPolicy, for the weekly periodograms of LearnWeeklyKV.
+	// They start at half the first value unless a policy for the
+	// collection sets its own BootstrapFactor
+
+	learning_lock.RLock()
+	p, ok := learning_policies[collname]
+	learning_lock.RUnlock()
+
+	if !ok {
+		return DEFAULT_WEEKLY_LEARNING_POLICY
+	}
+
+	if p.BootstrapFactor <= 0 {
+		p.BootstrapFactor = DEFAULT_WEEKLY_LEARNING_POLICY.BootstrapFactor
+	}
+
+	return p
+}
+
+// ***************************************************************************
+
+func (p LearningPolicy) Weight(dt float64) float64 {
+
+	// The weight of a new sample arriving dt nanoseconds after the last.
+	// With a half-life, memory decays as 2^(-dt/halflife). Samples at
+	// the same time, e.g. in a batch or a replay, would then weigh
+	// nothing, so they get Alpha
+
+	if p.HalfLife > 0 && dt > 0 {
+		return 1 - math.Exp(-math.Ln2 * dt / (p.HalfLife * NANO))
+	}
+
+	if p.Alpha <= 0 || p.Alpha > 1 {
+		return DEFAULT_LEARNING_POLICY.Alpha
+	}
+
+	return p.Alpha
+}
+
+// ***************************************************************************
+
+func (p LearningPolicy) Initial(q float64) float64 {
+
+	// The running average after the very first sample
+
+	switch p.Bootstrap {
+
+	case BOOTSTRAP_FIRST:
+		return q
+
+	case BOOTSTRAP_ZERO:
+		return 0
+
+	default:
+		factor := p.BootstrapFactor
+
+		if factor <= 0 {
+			factor = DEFAULT_LEARNING_POLICY.BootstrapFactor
+		}
+
+		return factor * q
+	}
+}
+
+// ***************************************************************************
+
+func (p LearningPolicy) Learn(old, q, dt float64) float64 {
+
+	w := p.Weight(dt)
+	return (1 - w) * old + w * q
+}
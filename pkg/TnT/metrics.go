@@ -0,0 +1,222 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* OpenMetrics (Prometheus) exposition of promise histories and trust
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ***************************************************************************
+
+const OPENMETRICS_CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// ***************************************************************************
+
+type metricFamily struct {
+
+	name    string
+	kind    string  // gauge or counter
+	help    string
+	samples []string
+}
+
+// ***************************************************************************
+
+func (f *metricFamily) add(labels []string, value float64) {
+
+	suffix := ""
+
+	if f.kind == "counter" {
+		suffix = "_total"
+	}
+
+	sample := f.name+suffix+"{"+strings.Join(labels,",")+"} "+strconv.FormatFloat(value,'g',-1,64)
+	f.samples = append(f.samples,sample)
+}
+
+// ***************************************************************************
+
+func MetricsHandler() http.Handler {
+
+	// Serve everything in the KV store on e.g. /metrics
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		w.Header().Set("Content-Type",OPENMETRICS_CONTENT_TYPE)
+		WriteOpenMetrics(w)
+	})
+}
+
+// ***************************************************************************
+
+func WriteOpenMetrics(w io.Writer) error {
+
+	// Read the promise collection and the PromiseKeeping reliabilities
+	// through the KV layer and write them as OpenMetrics text
+
+	q := &metricFamily{ name: "tnt_promise_q", kind: "gauge", help: "Last measured value of the promise quantity" }
+	q_av := &metricFamily{ name: "tnt_promise_q_av", kind: "gauge", help: "Running average of the promise quantity" }
+	q_var := &metricFamily{ name: "tnt_promise_q_var", kind: "gauge", help: "Running variance of the promise quantity" }
+	dt_av := &metricFamily{ name: "tnt_promise_interval_seconds", kind: "gauge", help: "Running average interval between samples" }
+	outcomes := &metricFamily{ name: "tnt_promise_outcomes", kind: "counter", help: "Promise outcomes kept, repaired, notkept, skipped" }
+	status := &metricFamily{ name: "tnt_promise_http_status", kind: "counter", help: "HTTP status classes of promises kept over HTTP" }
+	reliability := &metricFamily{ name: "tnt_promise_reliability", kind: "gauge", help: "Assessed running reliability of promise keeping" }
+
+	for _, key := range ListKV(PROMISE_COLLECTION) {
+
+		// Counters are name.outcome, canonical names never contain '.'
+
+		if dot := strings.LastIndexByte(key,'.'); dot > 0 {
+
+			kv := GetKV(PROMISE_COLLECTION,key)
+			name, what := key[:dot], key[dot+1:]
+
+			if strings.HasPrefix(what,"http_") {
+				status.add([]string{ MetricLabel("promise",name), MetricLabel("class",strings.TrimPrefix(what,"http_")) },kv.V)
+			} else {
+				outcomes.add([]string{ MetricLabel("promise",name), MetricLabel("outcome",what) },kv.V)
+			}
+
+			continue
+		}
+
+		// Histories always carry a sample time, plain KeyValues don't
+
+		exists, e := GetPromiseHistory(PROMISE_COLLECTION,key)
+
+		if !exists || e.T == 0 {
+			continue
+		}
+
+		labels := PromiseLabels(key)
+		labels = append(labels,MetricLabel("units",e.Units))
+
+		q.add(labels,e.Q)
+		q_av.add(labels,e.Q_av)
+		q_var.add(labels,e.Q_var)
+		dt_av.add(PromiseLabels(key),e.Dt_av/NANO)
+	}
+
+	// Observed quantities are apart from latency, and labelled so
+
+	for _, key := range ListKV(OBSERVE_COLLECTION) {
+
+		exists, e := GetPromiseHistory(OBSERVE_COLLECTION,key)
+
+		if !exists || e.T == 0 {
+			continue
+		}
+
+		labels := append(PromiseLabels(key),MetricLabel("collection",OBSERVE_COLLECTION))
+		dt_av.add(labels,e.Dt_av/NANO)
+
+		labels = append(labels,MetricLabel("units",e.Units))
+
+		q.add(labels,e.Q)
+		q_av.add(labels,e.Q_av)
+		q_var.add(labels,e.Q_var)
+	}
+
+	// Each dimension of a vector promise is a history of its own
+
+	for _, key := range ListKV(VECTOR_COLLECTION) {
+
+		exists, v := GetVectorHistory(VECTOR_COLLECTION,key)
+
+		if !exists {
+			continue
+		}
+
+		for _, dim := range v.Dimensions() {
+
+			e := v.Dims[dim]
+
+			labels := append(PromiseLabels(key),MetricLabel("dimension",dim))
+			dt_av.add(labels,e.Dt_av/NANO)
+
+			labels = append(labels,MetricLabel("units",e.Units))
+
+			q.add(labels,e.Q)
+			q_av.add(labels,e.Q_av)
+			q_var.add(labels,e.Q_var)
+		}
+	}
+
+	for _, key := range ListKV("PromiseKeeping") {
+
+		kv := GetKV("PromiseKeeping",key)
+		reliability.add(PromiseLabels(key),kv.V)
+	}
+
+	for _, key := range ListKV(VECTOR_KEEPING) {
+
+		kv := GetKV(VECTOR_KEEPING,key)
+		reliability.add(append(PromiseLabels(key),MetricLabel("collection",VECTOR_KEEPING)),kv.V)
+	}
+
+	out := bufio.NewWriter(w)
+
+	for _, f := range []*metricFamily{ q, q_av, q_var, dt_av, outcomes, status, reliability } {
+
+		fmt.Fprintf(out,"# TYPE %s %s\n",f.name,f.kind)
+		fmt.Fprintf(out,"# HELP %s %s\n",f.name,f.help)
+
+		for _, sample := range f.samples {
+			fmt.Fprintln(out,sample)
+		}
+	}
+
+	fmt.Fprintln(out,"# EOF")
+
+	return out.Flush()
+}
+
+// ***************************************************************************
+
+func PromiseLabels(key string) []string {
+
+	// History keys are name:timeslot, or just name over all time
+
+	name, slot, found := strings.Cut(key,":")
+
+	labels := []string{ MetricLabel("promise",name) }
+
+	if found {
+		labels = append(labels,MetricLabel("timeslot",slot))
+	}
+
+	return labels
+}
+
+// ***************************************************************************
+
+func MetricLabel(name, value string) string {
+
+	r := strings.NewReplacer(`\`,`\\`,`"`,`\"`,"\n",`\n`)
+	return name+`="`+r.Replace(value)+`"`
+}
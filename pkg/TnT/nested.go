@@ -0,0 +1,205 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Nested promises - a deploy promise made of fetch, verify and install
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************
+
+const ROLLUP_COLLECTION = "rollup"  // learned shares of a parent's latency
+
+func init() {
+
+	// Fractions are already normalized, so start from the first one,
+	// and average them over time rather than over the last two
+
+	SetLearningPolicy(ROLLUP_COLLECTION,LearningPolicy{ Alpha: 0.5, Bootstrap: BOOTSTRAP_FIRST, Blend: BLEND_AVERAGE })
+}
+
+// ***************************************************************************
+
+type PromiseLedger struct {
+
+	// What the children of one promise context have spent, by name
+
+	lock    sync.Mutex
+	latency map[string]float64
+}
+
+// ***************************************************************************
+
+func (l *PromiseLedger) Add(name string, latency float64) {
+
+	l.lock.Lock()
+
+	if l.latency == nil {
+		l.latency = make(map[string]float64)
+	}
+
+	l.latency[name] += latency
+	l.lock.Unlock()
+}
+
+// ***************************************************************************
+
+func (l *PromiseLedger) Latencies() map[string]float64 {
+
+	result := make(map[string]float64)
+
+	if l == nil {
+		return result
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for name, latency := range l.latency {
+		result[name] = latency
+	}
+
+	return result
+}
+
+// ***************************************************************************
+
+func PromiseContext_BeginChild(parent *PromiseContext, name string) PromiseContext {
+
+	before := time.Now()
+	return StampedPromiseContext_BeginChild(parent, name, before)
+}
+
+// ***************************************************************************
+
+func StampedPromiseContext_BeginChild(parent *PromiseContext, name string, before time.Time) PromiseContext {
+
+	// A sub-promise, named parent/name, in the parent's trace. The
+	// parent holds the lock for the whole family, so children don't lock
+
+	path := HashedKeyName(name)
+
+	if parent.Name != "" {
+		path = PromiseKey(parent.Name)+"/"+path
+	}
+
+	ctx := StampedPromiseContext_BeginUnlocked(path, before)
+	ctx.Name = path
+
+	ctx.JoinSpan(parent.SpanContext())
+
+	if parent.children == nil {
+		parent.children = &PromiseLedger{}
+	}
+
+	ctx.parent = parent.children
+
+	return ctx
+}
+
+// ***************************************************************************
+
+func PromiseContext_EndRollup(ctx PromiseContext) (PromiseHistory, map[string]float64) {
+
+	after := time.Now()
+	return StampedPromiseContext_EndRollup(ctx, after)
+}
+
+// ***************************************************************************
+
+func StampedPromiseContext_EndRollup(ctx PromiseContext, after time.Time) (PromiseHistory, map[string]float64) {
+
+	// End the parent as usual, then work out what fraction of its
+	// latency each child took, and learn those fractions over time.
+	// The parent's own name holds the share no child accounts for
+
+	e := StampedPromiseContext_End(ctx, after)
+
+	shares := make(map[string]float64)
+	total := float64(after.Sub(ctx.Time))
+
+	if !ctx.Plock.Ready || total <= 0 {
+		return e, shares
+	}
+
+	self := 1.0
+	now := after.UnixNano()
+
+	for child, latency := range ctx.children.Latencies() {
+
+		shares[child] = latency / total
+		self -= shares[child]
+		LearnUpdateKeyValue(ROLLUP_COLLECTION,child,now,shares[child],"fraction")
+	}
+
+	// Children may run in parallel, then they can account for it all
+
+	if self < 0 {
+		self = 0
+	}
+
+	shares[ctx.Name] = self
+	LearnUpdateKeyValue(ROLLUP_COLLECTION,ctx.Name,now,self,"fraction")
+
+	return e, shares
+}
+
+// ***************************************************************************
+
+func GetPromiseRollup(name string) map[string]float64 {
+
+	// The learned average share of the parent's latency for each
+	// direct child, and for the parent itself. The parent is named as
+	// it was begun: a flat name, or the path of a child with children
+
+	shares := make(map[string]float64)
+	keys := ListKV(ROLLUP_COLLECTION)
+
+	for _, name := range []string{ PromiseName(name), PromisePath(name) } {
+
+		for _, key := range keys {
+
+			if key != name && !strings.HasPrefix(key,name+"/") {
+				continue
+			}
+
+			if key != name && strings.Contains(strings.TrimPrefix(key,name+"/"),"/") {
+				continue // a grandchild
+			}
+
+			exists, e := GetPromiseHistory(ROLLUP_COLLECTION,key)
+
+			if exists {
+				shares[key] = e.Q_av
+			}
+		}
+
+		if len(shares) > 0 {
+			break
+		}
+	}
+
+	return shares
+}
@@ -0,0 +1,182 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Observations - any promised quantity (queue depth, bytes, error ratio),
+//* learned the same way as the latency of promise contexts
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"fmt"
+	"time"
+)
+
+// ***************************************************************************
+
+const EVENT_OBSERVE = "observe"  // a gauge or counter rate was learned
+const OBSERVE_COLLECTION = "observations"  // kept apart from the latency histories
+
+// ***************************************************************************
+
+func LearnPromiseSample(name, quantity string, t time.Time, q float64, units string) PromiseHistory {
+
+	// Promise latency, alongside the promise's counters and reliability
+
+	return LearnSample(PROMISE_COLLECTION,name,quantity,t,q,units)
+}
+
+// ***************************************************************************
+
+func LearnSample(collname, name, quantity string, t time.Time, q float64, units string) PromiseHistory {
+
+	// The learning every promise quantity gets: a history for its weekly
+	// DoughNowt timeslot and one over all time, both tracking the last three
+	// samples for derivatives, and an anomaly check against what came
+	// before. The name is canonical, and one collection holds only one
+	// quantity per name. Returns the timeslot history
+
+	_, timeslot := DoughNowt(t)
+
+	if !isFinite(q) {
+		fmt.Println("Rejected sample for",name,q,ErrNotFinite)
+		_, e := GetPromiseHistory(collname,name+":"+timeslot)
+		return e
+	}
+
+	if name == "" {
+		return LearnUpdateKeyValue(collname,timeslot,t.UnixNano(),q,units)
+	}
+
+	// What this promise usually does, before the new sample is learned
+
+	exists, expected := GetPromiseHistory(collname,AnomalyBaselineKey(name,timeslot))
+
+	e := LearnUpdateKeyValue(collname,name+":"+timeslot,t.UnixNano(),q,units)
+	LearnUpdateKeyValue(collname,name,t.UnixNano(),q,units)
+
+	DetectAnomaly(quantity,name,expected,exists,q,t)
+
+	return e
+}
+
+// ***************************************************************************
+
+func Observe(name string, value float64, units string) PromiseHistory {
+
+	return StampedObserve(name,value,units,time.Now())
+}
+
+// ***************************************************************************
+
+func StampedObserve(name string, value float64, units string, t time.Time) PromiseHistory {
+
+	// A gauge, the value itself is the sample, e.g. queue depth now.
+	// Inf and NaN are not learned
+
+	name = PromiseName(name)
+
+	e := LearnSample(OBSERVE_COLLECTION,name,"",t,value,units)
+
+	if !isFinite(value) {
+		return e
+	}
+
+	emitObservation(name,e,value,units,t)
+
+	return e
+}
+
+// ***************************************************************************
+
+func ObserveCounter(name string, total float64, units string) PromiseHistory {
+
+	return StampedObserveCounter(name,total,units,time.Now())
+}
+
+// ***************************************************************************
+
+func StampedObserveCounter(name string, total float64, units string, t time.Time) PromiseHistory {
+
+	// A counter only goes up, e.g. bytes sent since start, so what we
+	// learn is its rate per second. A counter that goes down has been
+	// reset, and has counted from zero since. The first total only
+	// sets the baseline
+
+	name = PromiseName(name)
+	collname := OBSERVE_COLLECTION
+
+	if !isFinite(total) {
+		return LearnSample(OBSERVE_COLLECTION,name,"",t,total,units)
+	}
+
+	var last KeyValue
+
+	last.K = name+"counter"
+	last.V = total
+	last.T = t.UnixNano()
+
+	unlock := LockKV(collname,last.K)
+	previous := GetKV(collname,last.K)
+	AddKV(collname,last)
+	unlock()
+
+	dt := float64(last.T - previous.T) / NANO
+
+	if previous.T == 0 || dt <= 0 {
+		_, timeslot := DoughNowt(t)
+		_, e := GetPromiseHistory(collname,name+":"+timeslot)
+		return e
+	}
+
+	increase := total - previous.V
+
+	if increase < 0 {
+		increase = total
+	}
+
+	rate := increase / dt
+	units = units+"/s"
+
+	e := LearnSample(OBSERVE_COLLECTION,name,"",t,rate,units)
+
+	emitObservation(name,e,rate,units,t)
+
+	return e
+}
+
+// ***************************************************************************
+
+func emitObservation(name string, e PromiseHistory, value float64, units string, t time.Time) {
+
+	var event PromiseEvent
+
+	event.Kind = EVENT_OBSERVE
+	event.Name = name
+	event.Key = OBSERVE_COLLECTION+":"+e.PromiseId
+	event.Time = t
+	event.Ready = true
+	event.Value = value
+	event.Units = units
+	event.Q_av = e.Q_av
+	event.Derivative = EstimateFirstDerivative(e,1,NANO).Value  // per second
+	event.Dt_av = e.Dt_av
+
+	EmitPromiseEvent(event)
+}
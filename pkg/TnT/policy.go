@@ -0,0 +1,260 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Promise lock policy, CFEngine style ifelapsed/expireafter per promise
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ***************************************************************************
+
+type PromisePolicy struct {
+
+	IfElapsed   int64   // seconds that must pass before the promise is kept again
+	ExpireAfter int64   // seconds before a running lock is considered stale and forced
+}
+
+// ***************************************************************************
+
+var DEFAULT_PROMISE_POLICY = PromisePolicy{ IfElapsed: 30, ExpireAfter: 60 }
+
+var policy_lock sync.RWMutex
+var policy_default = DEFAULT_PROMISE_POLICY
+var policy_exact = make(map[string]PromisePolicy)
+var policy_wild = make(map[string]PromisePolicy)
+
+// ***************************************************************************
+
+func SetPromisePolicy(pattern string, p PromisePolicy) {
+
+	// Register a policy for a promise name, or for a family of names with
+	// * wildcards, e.g. "health check*". Names are canonified with PromiseName()
+	// so they match the names used by the promise wrappers
+
+	key := CanonifyPattern(pattern)
+
+	policy_lock.Lock()
+	defer policy_lock.Unlock()
+
+	if strings.Contains(key,"*") {
+		policy_wild[key] = p
+	} else {
+		policy_exact[key] = p
+	}
+}
+
+// ***************************************************************************
+
+func SetDefaultPromisePolicy(p PromisePolicy) {
+
+	// The fallback when no name or pattern matches
+
+	policy_lock.Lock()
+	policy_default = p
+	policy_lock.Unlock()
+}
+
+// ***************************************************************************
+
+func ResetPromisePolicy() {
+
+	// Forget all overrides and restore the built-in default
+
+	policy_lock.Lock()
+	policy_default = DEFAULT_PROMISE_POLICY
+	policy_exact = make(map[string]PromisePolicy)
+	policy_wild = make(map[string]PromisePolicy)
+	policy_lock.Unlock()
+}
+
+// ***************************************************************************
+
+func GetPromisePolicy(name string) PromisePolicy {
+
+	// Exact names win, then the most specific matching wildcard pattern,
+	// i.e. the one with the most literal characters, then the default
+
+	key := PromiseName(name)
+
+	policy_lock.RLock()
+	defer policy_lock.RUnlock()
+
+	if p, ok := policy_exact[key]; ok {
+		return p
+	}
+
+	patterns := make([]string,0,len(policy_wild))
+
+	for pattern := range policy_wild {
+		patterns = append(patterns,pattern)
+	}
+
+	if pattern, ok := MostSpecificPattern(patterns,key); ok {
+		return policy_wild[pattern]
+	}
+
+	return policy_default
+}
+
+// ***************************************************************************
+
+func MostSpecificPattern(patterns []string, name string) (string,bool) {
+
+	// The matching wildcard pattern with the most literal characters
+
+	best := -1
+	best_pattern := ""
+
+	for _, pattern := range patterns {
+
+		if !MatchPattern(pattern,name) {
+			continue
+		}
+
+		specificity := len(pattern) - strings.Count(pattern,"*")
+
+		// Break ties deterministically, since map order is random
+
+		if specificity > best || (specificity == best && pattern < best_pattern) {
+			best = specificity
+			best_pattern = pattern
+		}
+	}
+
+	return best_pattern, best >= 0
+}
+
+// ***************************************************************************
+
+func LoadPromisePolicy(filename string) error {
+
+	// Read a policy file of the form
+	//
+	//   # promise name        ifelapsed  expireafter
+	//   *                     30         60
+	//   health check*         1          5
+	//   nightly backup        3600       7200
+	//
+	// The last two fields are integer seconds, everything before them is the name
+
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+
+	for scanner.Scan() {
+
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(text)
+
+		if len(fields) < 3 {
+			return fmt.Errorf("%s:%d: expected <name> <ifelapsed> <expireafter>",filename,line)
+		}
+
+		n := len(fields)
+
+		ifelapsed, err := strconv.ParseInt(fields[n-2],10,64)
+
+		if err != nil || ifelapsed < 0 {
+			return fmt.Errorf("%s:%d: bad ifelapsed value %q",filename,line,fields[n-2])
+		}
+
+		expireafter, err := strconv.ParseInt(fields[n-1],10,64)
+
+		if err != nil || expireafter < 0 {
+			return fmt.Errorf("%s:%d: bad expireafter value %q",filename,line,fields[n-1])
+		}
+
+		name := strings.Join(fields[:n-2]," ")
+
+		SetPromisePolicy(name,PromisePolicy{ IfElapsed: ifelapsed, ExpireAfter: expireafter })
+	}
+
+	return scanner.Err()
+}
+
+// ***************************************************************************
+
+func CanonifyPattern(s string) string {
+
+	// Canonify each literal part of a wildcard pattern, keeping the *s
+
+	parts := strings.Split(strings.TrimSpace(s),"*")
+
+	for i := range parts {
+		if len(parts[i]) > 0 {
+			parts[i] = PromiseName(parts[i])
+		}
+	}
+
+	return strings.Join(parts,"*")
+}
+
+// ***************************************************************************
+
+func MatchPattern(pattern, name string) bool {
+
+	// Simple glob where * matches any run of characters
+
+	parts := strings.Split(pattern,"*")
+
+	if len(parts) == 1 {
+		return pattern == name
+	}
+
+	if !strings.HasPrefix(name,parts[0]) {
+		return false
+	}
+
+	name = name[len(parts[0]):]
+
+	for i := 1; i < len(parts)-1; i++ {
+
+		pos := strings.Index(name,parts[i])
+
+		if pos < 0 {
+			return false
+		}
+
+		name = name[pos+len(parts[i]):]
+	}
+
+	return strings.HasSuffix(name,parts[len(parts)-1])
+}
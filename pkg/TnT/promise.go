@@ -0,0 +1,134 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Promise declarations - who promises what to whom, so that outcomes can
+//* be assessed against what was actually promised
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// ***************************************************************************
+
+type Promise struct {
+
+	// A promise body from promiser to promisee, with the quantitative
+	// part that outcomes are assessed against. Name is the name used by
+	// the promise wrappers
+
+	Name     string
+	Promiser string
+	Promisee string
+	Body     string   // what is promised, in words
+
+	Latency  float64  // upper bound on latency (s), 0 means no assessment
+	Interval float64  // the sampling interval we trust (s), 0 means the default
+	Quality  float64  // the least payload quality promised (0 to 1), 0 means 1
+}
+
+// ***************************************************************************
+
+var promise_lock sync.RWMutex
+var promises = make(map[string]Promise)
+
+// ***************************************************************************
+
+func DeclarePromise(p Promise) Promise {
+
+	// Register or replace the promise for p.Name, returned with the
+	// canonical name
+
+	p.Name = PromiseKey(p.Name)
+
+	promise_lock.Lock()
+	promises[p.Name] = p
+	promise_lock.Unlock()
+
+	return p
+}
+
+// ***************************************************************************
+
+func RetractPromise(name string) {
+
+	promise_lock.Lock()
+	delete(promises,PromiseKey(name))
+	promise_lock.Unlock()
+}
+
+// ***************************************************************************
+
+func GetPromise(name string) (Promise, bool) {
+
+	promise_lock.RLock()
+	defer promise_lock.RUnlock()
+
+	p, ok := promises[PromiseKey(name)]
+	return p, ok
+}
+
+// ***************************************************************************
+
+func DeclaredPromises() []Promise {
+
+	promise_lock.RLock()
+	defer promise_lock.RUnlock()
+
+	list := make([]Promise,0,len(promises))
+
+	for _, p := range promises {
+		list = append(list,p)
+	}
+
+	sort.Slice(list,func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// ***************************************************************************
+
+func AssessDeclaredPromise(p Promise, e PromiseHistory, quality float64) (float64,bool) {
+
+	// Judge a sample of the history against the declared bounds. The
+	// payload quality counts as fully kept if it meets the promised level
+
+	if p.Latency <= 0 {
+		return 0, false
+	}
+
+	interval := p.Interval
+
+	if interval <= 0 {
+		interval = DEFAULT_PROMISE_BOUND.Interval
+	}
+
+	promised := p.Quality
+
+	if promised <= 0 {
+		promised = 1
+	}
+
+	quality = math.Max(0,math.Min(1,quality / promised))
+
+	return AssessPromiseOutcome(e,quality,p.Latency,interval), true
+}
@@ -0,0 +1,374 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Streaming quantiles - a small DDSketch, so we can ask for p95/p99
+//* without keeping every sample
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ***************************************************************************
+
+const SKETCH_ALPHA = 0.01        // relative accuracy of quantile estimates
+const SKETCH_MAX_BINS = 2048     // collapse the smallest bins beyond this
+const SKETCH_MIN_VALUE = 1e-9    // magnitudes below this count as zero
+
+var ErrSketchAlpha = errors.New("quantile sketches have different accuracy")
+
+// ***************************************************************************
+
+type QuantileSketch struct {
+
+	// Values fall into logarithmic bins gamma^(i-1) < |v| <= gamma^i,
+	// so every estimate is within a relative error alpha of the truth.
+	// Two sketches with the same alpha merge by adding their bins
+
+	Alpha  float64          `json:"alpha"`
+	Pos    map[int]float64  `json:"pos,omitempty"`
+	Neg    map[int]float64  `json:"neg,omitempty"`
+	Zeros  float64          `json:"zeros,omitempty"`
+	Count  float64          `json:"n"`
+	Min    float64          `json:"min"`
+	Max    float64          `json:"max"`
+}
+
+// ***************************************************************************
+
+func NewQuantileSketch(alpha float64) *QuantileSketch {
+
+	if alpha <= 0 || alpha >= 1 {
+		alpha = SKETCH_ALPHA
+	}
+
+	var s QuantileSketch
+
+	s.Alpha = alpha
+	s.Pos = make(map[int]float64)
+	s.Neg = make(map[int]float64)
+	return &s
+}
+
+// ***************************************************************************
+
+func (s *QuantileSketch) gamma() float64 {
+
+	return (1 + s.Alpha) / (1 - s.Alpha)
+}
+
+// ***************************************************************************
+
+func (s *QuantileSketch) index(v float64) int {
+
+	return int(math.Ceil(math.Log(v) / math.Log(s.gamma())))
+}
+
+// ***************************************************************************
+
+func (s *QuantileSketch) value(i int) float64 {
+
+	// The point in the bin with the least relative error
+
+	g := s.gamma()
+	return 2 * math.Pow(g,float64(i)) / (g + 1)
+}
+
+// ***************************************************************************
+
+func (s *QuantileSketch) Add(v float64) {
+
+	if s.Pos == nil {
+		s.Pos = make(map[int]float64)
+	}
+
+	if s.Neg == nil {
+		s.Neg = make(map[int]float64)
+	}
+
+	switch {
+	case v > SKETCH_MIN_VALUE:
+		s.Pos[s.index(v)]++
+	case v < -SKETCH_MIN_VALUE:
+		s.Neg[s.index(-v)]++
+	default:
+		s.Zeros++
+	}
+
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+
+	s.Count++
+	s.collapse()
+}
+
+// ***************************************************************************
+
+func (s *QuantileSketch) Merge(o *QuantileSketch) error {
+
+	// Only sketches with the same accuracy can be merged, their bins
+	// are different otherwise. An empty sketch takes the other's alpha
+
+	if o == nil || o.Count == 0 {
+		return nil
+	}
+
+	if s.Count == 0 {
+		s.Alpha = o.Alpha
+	}
+
+	if s.Alpha != o.Alpha {
+		return fmt.Errorf("%w: alpha %g and %g",ErrSketchAlpha,s.Alpha,o.Alpha)
+	}
+
+	if s.Pos == nil {
+		s.Pos = make(map[int]float64)
+	}
+
+	if s.Neg == nil {
+		s.Neg = make(map[int]float64)
+	}
+
+	for i, n := range o.Pos {
+		s.Pos[i] += n
+	}
+
+	for i, n := range o.Neg {
+		s.Neg[i] += n
+	}
+
+	if s.Count == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+
+	if s.Count == 0 || o.Max > s.Max {
+		s.Max = o.Max
+	}
+
+	s.Zeros += o.Zeros
+	s.Count += o.Count
+	s.collapse()
+
+	return nil
+}
+
+// ***************************************************************************
+
+func (s *QuantileSketch) collapse() {
+
+	// Keep memory bounded by folding the smallest magnitudes together,
+	// which sacrifices accuracy only in the uninteresting low tail
+
+	for len(s.Pos) > SKETCH_MAX_BINS {
+
+		keys := sortedBins(s.Pos)
+		s.Pos[keys[1]] += s.Pos[keys[0]]
+		delete(s.Pos,keys[0])
+	}
+
+	for len(s.Neg) > SKETCH_MAX_BINS {
+
+		keys := sortedBins(s.Neg)
+		s.Neg[keys[1]] += s.Neg[keys[0]]
+		delete(s.Neg,keys[0])
+	}
+}
+
+// ***************************************************************************
+
+func (s *QuantileSketch) Quantile(q float64) float64 {
+
+	// Estimate the value below which a fraction q of samples lie
+
+	if s == nil || s.Count == 0 {
+		return 0
+	}
+
+	if q <= 0 {
+		return s.Min
+	}
+
+	if q >= 1 {
+		return s.Max
+	}
+
+	rank := q * (s.Count - 1)
+	var seen float64
+
+	// From the most negative, through zero, to the most positive
+
+	neg := sortedBins(s.Neg)
+
+	for i := len(neg)-1; i >= 0; i-- {
+
+		seen += s.Neg[neg[i]]
+
+		if seen > rank {
+			return s.clamp(-s.value(neg[i]))
+		}
+	}
+
+	seen += s.Zeros
+
+	if seen > rank {
+		return 0
+	}
+
+	for _, i := range sortedBins(s.Pos) {
+
+		seen += s.Pos[i]
+
+		if seen > rank {
+			return s.clamp(s.value(i))
+		}
+	}
+
+	return s.Max
+}
+
+// ***************************************************************************
+
+func (s *QuantileSketch) clamp(v float64) float64 {
+
+	return math.Max(s.Min,math.Min(s.Max,v))
+}
+
+// ***************************************************************************
+
+func (s *QuantileSketch) Copy() *QuantileSketch {
+
+	c := NewQuantileSketch(s.Alpha)
+	c.Merge(s)
+	return c
+}
+
+// ***************************************************************************
+
+func sortedBins(bins map[int]float64) []int {
+
+	keys := make([]int,0,len(bins))
+
+	for i := range bins {
+		keys = append(keys,i)
+	}
+
+	sort.Ints(keys)
+	return keys
+}
+
+// ***************************************************************************
+// Queries on stored promise histories
+// ***************************************************************************
+
+func GetPromiseQuantile(name string, q float64) (bool,float64) {
+
+	// Over all time, from the per-promise history kept by the wrappers
+
+	return getQuantile(PROMISE_COLLECTION,name,q)
+}
+
+// ***************************************************************************
+
+func GetPromiseSlotQuantile(name, slot string, q float64) (bool,float64) {
+
+	// For one DoughNowt() weekly timeslot, e.g. "Mon:Hr09:Min00_05"
+
+	return getSlotsQuantile(PROMISE_COLLECTION,name,[]string{ slot },q)
+}
+
+// ***************************************************************************
+
+func GetPromiseSlotsQuantile(name string, slots []string, q float64) (bool,float64) {
+
+	// Merge the sketches of several timeslots, e.g. all of Monday morning
+
+	return getSlotsQuantile(PROMISE_COLLECTION,name,slots,q)
+}
+
+// ***************************************************************************
+
+func GetObservedQuantile(name string, q float64) (bool,float64) {
+
+	// The same, for quantities learned by Observe and ObserveCounter
+
+	return getQuantile(OBSERVE_COLLECTION,name,q)
+}
+
+// ***************************************************************************
+
+func GetObservedSlotQuantile(name, slot string, q float64) (bool,float64) {
+
+	return getSlotsQuantile(OBSERVE_COLLECTION,name,[]string{ slot },q)
+}
+
+// ***************************************************************************
+
+func GetObservedSlotsQuantile(name string, slots []string, q float64) (bool,float64) {
+
+	return getSlotsQuantile(OBSERVE_COLLECTION,name,slots,q)
+}
+
+// ***************************************************************************
+
+func getQuantile(collname, name string, q float64) (bool,float64) {
+
+	exists, e := GetPromiseHistory(collname,PromiseName(name))
+
+	if !exists || e.Sketch == nil {
+		return false, 0
+	}
+
+	return true, e.Sketch.Quantile(q)
+}
+
+// ***************************************************************************
+
+func getSlotsQuantile(collname, name string, slots []string, q float64) (bool,float64) {
+
+	merged := NewQuantileSketch(SKETCH_ALPHA)
+
+	for _, slot := range slots {
+
+		exists, e := GetPromiseHistory(collname,PromiseName(name)+":"+slot)
+
+		if !exists {
+			continue
+		}
+
+		if err := merged.Merge(e.Sketch); err != nil {
+			fmt.Println("Skipping timeslot",slot,err)
+		}
+	}
+
+	if merged.Count == 0 {
+		return false, 0
+	}
+
+	return true, merged.Quantile(q)
+}
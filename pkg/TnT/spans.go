@@ -0,0 +1,442 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Spans - promise contexts exported in the shape of OpenTelemetry (OTLP/JSON)
+//* spans, so that promise timings can join the caller's trace trees
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************
+
+const SPAN_KIND_INTERNAL = 1
+const SPAN_STATUS_OK = 1
+const SPAN_STATUS_ERROR = 2
+
+// ***************************************************************************
+
+type SpanContext struct {
+
+	TraceID string  // 32 hex digits
+	SpanID  string  // 16 hex digits
+	Flags   string  // W3C trace-flags, 2 hex digits, "" means sampled (01)
+}
+
+// ***************************************************************************
+
+type Span struct {
+
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []SpanAttribute `json:"attributes,omitempty"`
+	Status            SpanStatus      `json:"status"`
+}
+
+type SpanAttribute struct {
+
+	Key   string     `json:"key"`
+	Value SpanValue  `json:"value"`
+}
+
+type SpanValue struct {
+
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type SpanStatus struct {
+
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ***************************************************************************
+
+type SpanExporter interface {
+
+	ExportSpan(s Span)
+}
+
+// ***************************************************************************
+
+var span_lock sync.RWMutex
+var span_exporter SpanExporter
+
+// ***************************************************************************
+
+func SetSpanExporter(e SpanExporter) {
+
+	// nil turns span export off, which is the default
+
+	span_lock.Lock()
+	span_exporter = e
+	span_lock.Unlock()
+}
+
+// ***************************************************************************
+
+func ExportPromiseSpan(s Span) {
+
+	span_lock.RLock()
+	e := span_exporter
+	span_lock.RUnlock()
+
+	if e != nil {
+		e.ExportSpan(s)
+	}
+}
+
+// ***************************************************************************
+// Passing the parent span through context.Context
+// ***************************************************************************
+
+type spanKey struct{}
+
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+
+	// Callers with their own tracer put its current trace and span id
+	// here, so that promise spans become its children
+
+	return context.WithValue(ctx,spanKey{},sc)
+}
+
+// ***************************************************************************
+
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+
+	sc, ok := ctx.Value(spanKey{}).(SpanContext)
+	return sc, ok && sc.TraceID != ""
+}
+
+// ***************************************************************************
+
+func ParseTraceparent(header string) (SpanContext, error) {
+
+	// W3C trace context: version-traceid-parentid-flags, in lowercase
+	// hex. Version ff and all-zero ids are invalid. Later versions may
+	// add fields, version 00 may not
+
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(header),"-")
+
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("bad traceparent %q",header)
+	}
+
+	version, trace, span, flags := parts[0], parts[1], parts[2], parts[3]
+
+	if !isLowerHex(version,2) || version == "ff" || !isLowerHex(flags,2) {
+		return sc, fmt.Errorf("bad traceparent %q",header)
+	}
+
+	if !isLowerHex(trace,32) || !isLowerHex(span,16) || isZeroHex(trace) || isZeroHex(span) {
+		return sc, fmt.Errorf("bad traceparent %q",header)
+	}
+
+	sc.TraceID = trace
+	sc.SpanID = span
+	sc.Flags = flags
+	return sc, nil
+}
+
+// ***************************************************************************
+
+func isLowerHex(s string, n int) bool {
+
+	if len(s) != n {
+		return false
+	}
+
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ***************************************************************************
+
+func isZeroHex(s string) bool {
+
+	return strings.Trim(s,"0") == ""
+}
+
+// ***************************************************************************
+
+func (sc SpanContext) Traceparent() string {
+
+	// The W3C traceparent header naming this span as the parent, with
+	// the flags we were given, else sampled
+
+	flags := sc.Flags
+
+	if flags == "" {
+		flags = "01"
+	}
+
+	return "00-"+sc.TraceID+"-"+sc.SpanID+"-"+flags
+}
+
+// ***************************************************************************
+
+func (ctx *PromiseContext) JoinSpan(sc SpanContext) {
+
+	// Make the promise's span a child of sc, in its trace
+
+	ctx.TraceID = sc.TraceID
+	ctx.ParentSpanID = sc.SpanID
+	ctx.TraceFlags = sc.Flags
+}
+
+// ***************************************************************************
+
+func (ctx PromiseContext) SpanContext() SpanContext {
+
+	// The promise's own span, as a parent for others
+
+	return SpanContext{ TraceID: ctx.TraceID, SpanID: ctx.SpanID, Flags: ctx.TraceFlags }
+}
+
+// ***************************************************************************
+
+func NewTraceID() string {
+
+	return randomHex(16)
+}
+
+// ***************************************************************************
+
+func NewSpanID() string {
+
+	return randomHex(8)
+}
+
+// ***************************************************************************
+
+func randomHex(n int) string {
+
+	b := make([]byte,n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ***************************************************************************
+
+func PromiseSpan(ctx PromiseContext, after time.Time, attrs map[string]any) Span {
+
+	var s Span
+
+	s.TraceId = ctx.TraceID
+	s.SpanId = ctx.SpanID
+	s.ParentSpanId = ctx.ParentSpanID
+	s.Name = ctx.Name
+	s.Kind = SPAN_KIND_INTERNAL
+	s.StartTimeUnixNano = strconv.FormatInt(ctx.Time.UnixNano(),10)
+	s.EndTimeUnixNano = strconv.FormatInt(after.UnixNano(),10)
+
+	if ctx.Plock.Ready {
+		s.Status.Code = SPAN_STATUS_OK
+	} else {
+		s.Status.Code = SPAN_STATUS_ERROR
+		s.Status.Message = "promise denied: "+ctx.Plock.Reason
+	}
+
+	for _, k := range sortedAttrKeys(attrs) {
+		s.Attributes = append(s.Attributes,SpanAttr(k,attrs[k]))
+	}
+
+	return s
+}
+
+// ***************************************************************************
+
+func SpanAttr(key string, v any) SpanAttribute {
+
+	a := SpanAttribute{ Key: key }
+
+	switch t := v.(type) {
+	case bool:
+		a.Value.BoolValue = &t
+	case float64:
+		if math.IsInf(t,0) || math.IsNaN(t) {
+			str := fmt.Sprint(t)  // JSON has no Inf or NaN
+			a.Value.StringValue = &str
+		} else {
+			a.Value.DoubleValue = &t
+		}
+	case string:
+		a.Value.StringValue = &t
+	default:
+		str := fmt.Sprint(v)
+		a.Value.StringValue = &str
+	}
+
+	return a
+}
+
+// ***************************************************************************
+
+func sortedAttrKeys(attrs map[string]any) []string {
+
+	keys := make([]string,0,len(attrs))
+
+	for k := range attrs {
+		keys = append(keys,k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// ***************************************************************************
+// In-process collector, e.g. to forward to an OpenTelemetry SDK
+// ***************************************************************************
+
+type SpanCollector struct {
+
+	lock  sync.Mutex
+	spans []Span
+}
+
+func (c *SpanCollector) ExportSpan(s Span) {
+
+	c.lock.Lock()
+	c.spans = append(c.spans,s)
+	c.lock.Unlock()
+}
+
+// ***************************************************************************
+
+func (c *SpanCollector) Drain() []Span {
+
+	// Return and forget the spans collected so far
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	spans := c.spans
+	c.spans = nil
+	return spans
+}
+
+// ***************************************************************************
+// File exporter, one OTLP/JSON ExportTraceServiceRequest per line
+// ***************************************************************************
+
+type FileSpanExporter struct {
+
+	Service string
+
+	lock    sync.Mutex
+	file    *os.File
+}
+
+// ***************************************************************************
+
+func NewFileSpanExporter(filename, service string) (*FileSpanExporter, error) {
+
+	f, err := os.OpenFile(filename,os.O_CREATE|os.O_WRONLY|os.O_APPEND,0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSpanExporter{ Service: service, file: f }, nil
+}
+
+// ***************************************************************************
+
+func (x *FileSpanExporter) ExportSpan(s Span) {
+
+	request := map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": []SpanAttribute{ SpanAttr("service.name",x.Service) },
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]any{ "name": "TnT" },
+						"spans": []Span{ s },
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(request)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr,"Unable to encode span",s.Name,err)
+		return
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if x.file == nil {
+		return
+	}
+
+	_, err = x.file.Write(append(data,'\n'))
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr,"Unable to write span",s.Name,err)
+	}
+}
+
+// ***************************************************************************
+
+func (x *FileSpanExporter) Close() error {
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if x.file == nil {
+		return nil
+	}
+
+	err := x.file.Close()
+	x.file = nil
+	return err
+}
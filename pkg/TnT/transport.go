@@ -0,0 +1,179 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* HTTP client - assessing how well remote agents keep their promises
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ***************************************************************************
+
+type PromiseBound struct {
+
+	Latency  float64  // promised upper bound on latency (s)
+	Interval float64  // the sampling interval we trust (s)
+}
+
+var DEFAULT_PROMISE_BOUND = PromiseBound{ Latency: 1, Interval: 60 }
+
+// ***************************************************************************
+
+type PromiseTransport struct {
+
+	Base    http.RoundTripper        // nil means http.DefaultTransport
+	Bounds  map[string]PromiseBound  // per remote host (with port if given)
+	Default PromiseBound             // zero means DEFAULT_PROMISE_BOUND
+
+	lock    sync.Mutex
+	scores  map[string]float64
+}
+
+// ***************************************************************************
+
+func RemotePromiseName(host string) string {
+
+	// Each remote host is a promiser, in its own promise namespace.
+	// A long host:port ends in a hash, so different ports or hosts
+	// don't collide
+
+	return HashedKeyName("remote "+host)
+}
+
+// ***************************************************************************
+
+func (t *PromiseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// The latency is the time to the response headers, the body is
+	// the caller's business. Requests overlap, so no lock is taken
+
+	base := t.Base
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	host := req.URL.Host
+	name := RemotePromiseName(host)
+
+	pctx := StampedPromiseContext_BeginUnlocked(name,time.Now())
+
+	// Join the caller's trace, from the request context or a traceparent
+	// it set, and pass ours upstream so the server's spans join too. A
+	// RoundTripper must not change the caller's request
+
+	if sc, ok := SpanFromContext(req.Context()); ok {
+		pctx.JoinSpan(sc)
+	} else if sc, err := ParseTraceparent(req.Header.Get("traceparent")); err == nil {
+		pctx.JoinSpan(sc)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("traceparent",pctx.SpanContext().Traceparent())
+
+	resp, err := base.RoundTrip(req)
+
+	// A transport error or a server error is a broken promise
+
+	quality := 1.0
+	outcome := PROMISE_KEPT
+
+	if err != nil || resp.StatusCode >= 500 {
+		quality = 0
+		outcome = PROMISE_NOT_KEPT
+	}
+
+	// A promise declared for the host is assessed by End, once, like
+	// any other declared promise. Otherwise assess the host against
+	// its bounds here, over all time rather than per weekly timeslot
+
+	e := StampedPromiseContext_EndQuality(pctx,time.Now(),quality)
+
+	RecordOutcome(name,outcome)
+
+	var reliability float64
+
+	if p, declared := GetPromise(name); declared && p.Latency > 0 {
+		reliability = GetKV("PromiseKeeping",e.PromiseId).V
+	} else {
+		_, all := GetPromiseHistory(PROMISE_COLLECTION,name)
+		bound := t.Bound(host)
+		reliability = AssessPromiseOutcome(all,quality,bound.Latency,bound.Interval)
+	}
+
+	t.lock.Lock()
+
+	if t.scores == nil {
+		t.scores = make(map[string]float64)
+	}
+
+	t.scores[host] = reliability
+	t.lock.Unlock()
+
+	return resp, err
+}
+
+// ***************************************************************************
+
+func (t *PromiseTransport) Bound(host string) PromiseBound {
+
+	if b, ok := t.Bounds[host]; ok {
+		return b
+	}
+
+	if t.Default.Latency > 0 {
+		return t.Default
+	}
+
+	return DEFAULT_PROMISE_BOUND
+}
+
+// ***************************************************************************
+
+func (t *PromiseTransport) Reliability(host string) (float64, bool) {
+
+	// The latest running reliability assessed for a remote host
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	r, ok := t.scores[host]
+	return r, ok
+}
+
+// ***************************************************************************
+
+func (t *PromiseTransport) Reliabilities() map[string]float64 {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	result := make(map[string]float64,len(t.scores))
+
+	for host, r := range t.scores {
+		result[host] = r
+	}
+
+	return result
+}
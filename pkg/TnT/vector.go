@@ -0,0 +1,310 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// ***************************************************************************
+//*
+//* Vector promises - several facets of one promise (latency, payload size,
+//* correctness) learned together and assessed as one promise-kept level
+//*
+// ***************************************************************************
+
+package TnT
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// ***************************************************************************
+
+const VECTOR_COLLECTION = "vectors"
+const VECTOR_KEEPING = "VectorKeeping"  // reliabilities of vector promises
+
+// ***************************************************************************
+
+type VectorHistory struct {
+
+	// One scalar history per named dimension, each with its own
+	// average, variance and last three samples for derivatives
+
+	PromiseId string                    `json:"_key"`
+	T         int64                     `json:"lastT"`
+	Dims      map[string]PromiseHistory `json:"dims"`
+}
+
+// ***************************************************************************
+
+type DimensionBound struct {
+
+	Bound  float64  // the promised value, in the dimension's units
+	Weight float64  // share of the combined level, 0 means 1
+	Higher bool     // more is better (e.g. correctness), else less (latency)
+}
+
+// ***************************************************************************
+
+func (v VectorHistory) Dimensions() []string {
+
+	names := make([]string,0,len(v.Dims))
+
+	for name := range v.Dims {
+		names = append(names,name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// ***************************************************************************
+
+func AddVectorHistory(collname, key string, v VectorHistory) error {
+
+	data, err := json.Marshal(v)
+
+	if err == nil {
+		err = WriteKV(collname,key,data)
+	}
+
+	if err != nil {
+		fmt.Println("Unable to write promise",key,err)
+	}
+
+	return err
+}
+
+// ***************************************************************************
+
+func GetVectorHistory(collname, key string) (bool,VectorHistory) {
+
+	var v VectorHistory
+
+	data, err := os.ReadFile(KVPath(collname,key))
+
+	if err == nil {
+		err = json.Unmarshal(data,&v)
+	}
+
+	if err != nil {
+		var dud VectorHistory
+		dud.PromiseId = key
+		dud.Dims = make(map[string]PromiseHistory)
+		return false, dud
+	}
+
+	if v.Dims == nil {
+		v.Dims = make(map[string]PromiseHistory)
+	}
+
+	return true, v
+}
+
+// ***************************************************************************
+
+func LearnUpdateVector(collname, key string, now int64, values map[string]float64, units map[string]string) VectorHistory {
+
+	// Learn each dimension present in values, the others keep their
+	// history until they are measured again
+
+	unlock := LockKV(collname,key)
+	defer unlock()
+
+	_, v := GetVectorHistory(collname,key)
+
+	policy := GetLearningPolicy(collname)
+
+	for dim, q := range values {
+
+		if !isFinite(q) {
+			fmt.Println("Rejected sample for",collname+key,dim,q,ErrNotFinite)
+			continue
+		}
+
+		previous, exists := v.Dims[dim]
+
+		u, ok := units[dim]
+
+		if !ok {
+			u = previous.Units
+		}
+
+		e := UpdatePromiseHistory(previous,exists,now,q,u,policy)
+		e.PromiseId = key
+
+		v.Dims[dim] = e
+	}
+
+	v.PromiseId = key
+	v.T = now
+
+	AddVectorHistory(collname,key,v)
+
+	return v
+}
+
+// ***************************************************************************
+
+func ObserveVector(name string, values map[string]float64, units map[string]string) VectorHistory {
+
+	return StampedObserveVector(name,values,units,time.Now())
+}
+
+// ***************************************************************************
+
+func StampedObserveVector(name string, values map[string]float64, units map[string]string, t time.Time) VectorHistory {
+
+	// Like the scalar promises, for the DoughNowt timeslot and for all
+	// time. Returns the timeslot history
+
+	name = PromiseName(name)
+
+	_, timeslot := DoughNowt(t)
+
+	v := LearnUpdateVector(VECTOR_COLLECTION,name+":"+timeslot,t.UnixNano(),values,units)
+	LearnUpdateVector(VECTOR_COLLECTION,name,t.UnixNano(),values,units)
+
+	return v
+}
+
+// ***************************************************************************
+
+func DimensionLevel(e PromiseHistory, b DimensionBound, trust_interval float64) (float64,[]string) {
+
+	return LogisticAssessor{}.DimensionLevel(e,b,trust_interval)
+}
+
+// ***************************************************************************
+
+func (l LogisticAssessor) DimensionLevel(e PromiseHistory, b DimensionBound, trust_interval float64) (float64,[]string) {
+
+	// How well one facet kept its promise, between 0 and 1, by the same
+	// rules as the scalar assessment: a logistic step at the bound, a
+	// penalty for noise, and rewards or penalties for significant trends
+
+	l = l.defaults()
+
+	var notes []string
+
+	if b.Bound == 0 {
+		return 0, []string{ "no bound" }
+	}
+
+	trust_ns := trust_interval * NANO
+	direction := 1.0
+
+	if b.Higher {
+		direction = -1
+	}
+
+	level := 1/(1+math.Exp(direction*l.Slope*(e.Q-b.Bound)/math.Abs(b.Bound)))
+
+	if math.Abs(e.Q_av) < math.Sqrt(e.Q_var) {
+		notes = append(notes,"noisy")
+		level = level / l.NoisePenalty
+	}
+
+	// A trend towards the wrong side of the bound is bad
+
+	dqdt := EstimateFirstDerivative(e,math.Abs(b.Bound),trust_ns)
+	d2qdt2 := EstimateSecondDerivative(e,math.Abs(b.Bound),trust_ns)
+
+	if s := dqdt.Significant(SIGNIFICANCE); s != 0 {
+		notes = append(notes,"gradient "+dqdt.String())
+		level = level - l.Step * float64(s) * direction
+	}
+
+	if s := d2qdt2.Significant(SIGNIFICANCE); s != 0 {
+		notes = append(notes,"curvature "+d2qdt2.String())
+		level = level - l.Step * float64(s) * direction
+	}
+
+	return math.Max(0,math.Min(1,level)), notes
+}
+
+// ***************************************************************************
+
+func AssessVectorOutcome(v VectorHistory, assessed_quality float64, bounds map[string]DimensionBound, trust_interval float64) float64 {
+
+	// Combine the facets with bounds into one promise-kept level, their
+	// weighted average, and learn the reliability of the whole promise.
+	// The facets are graded like scalar promises of the same name, by
+	// their LogisticAssessor if one is selected (see SetAssessor)
+
+	l, ok := GetAssessor(v.PromiseId).(LogisticAssessor)
+
+	if !ok {
+		l = LogisticAssessor{}
+	}
+
+	l = l.defaults()
+
+	var notes []string
+	var level, weights float64
+
+	for _, dim := range v.Dimensions() {
+
+		b, ok := bounds[dim]
+
+		if !ok {
+			continue
+		}
+
+		w := b.Weight
+
+		if w == 0 {
+			w = 1
+		}
+
+		dl, why := l.DimensionLevel(v.Dims[dim],b,trust_interval)
+
+		notes = append(notes,fmt.Sprintf("%s level %.3f weight %g %v",dim,dl,w,why))
+
+		level += w * dl
+		weights += w
+	}
+
+	if weights > 0 {
+		level = level / weights
+	}
+
+	delta := level * assessed_quality
+
+	// Kept apart from the reliability of a scalar promise of the same name
+
+	previous, reliability := blendReliability(VECTOR_KEEPING,v.PromiseId,delta,l.Memory)
+
+	var event PromiseEvent
+
+	event.Kind = EVENT_ASSESS
+	event.Key = VECTOR_KEEPING+":"+v.PromiseId
+	event.Name = v.PromiseId
+	event.Time = time.Now()
+	event.Ready = true
+	event.Interval = trust_interval
+	event.Quality = assessed_quality
+	event.Level = level
+	event.Previous = previous
+	event.Reliability = reliability
+	event.Delta = delta
+	event.Notes = notes
+
+	EmitPromiseEvent(event)
+
+	return reliability
+}
@@ -0,0 +1,129 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ****************************************************************************
+//
+// Many goroutines hammering context, counters, histories and locks at once.
+// Run with the race detector:
+//
+//   go run -race test_concurrency.go
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"TnT"
+)
+
+// ***********************************************************************
+
+const WORKERS = 16
+const ROUNDS = 50
+
+// ***********************************************************************
+
+func main() {
+
+	TnT.InitializeContext()
+	TnT.SetInstrumentationSink(nil)
+
+	var wg sync.WaitGroup
+	var ready atomic.Int64
+
+	// A lock that nobody releases during the test, only one may win it
+
+	TnT.SetPromisePolicy("contended",TnT.PromisePolicy{ IfElapsed: 0, ExpireAfter: 3600 })
+
+	var contenders []TnT.PromiseContext
+	var contenders_lock sync.Mutex
+
+	for w := 0; w < WORKERS; w++ {
+
+		wg.Add(1)
+
+		go func(w int) {
+
+			defer wg.Done()
+
+			ctx := TnT.PromiseContext_Begin("contended")
+
+			if ctx.Ready() {
+				ready.Add(1)
+			}
+
+			contenders_lock.Lock()
+			contenders = append(contenders,ctx)
+			contenders_lock.Unlock()
+
+			for i := 0; i < ROUNDS; i++ {
+
+				TnT.ContextActive(fmt.Sprintf("worker_%d",w))
+				TnT.SetContext("shared",float64(i)/ROUNDS)
+				TnT.IsDefinedContext("shared | worker_1.worker_2")
+				TnT.ContextSet()
+
+				TnT.IncrementKV("concurrency","counter",1)
+
+				p := TnT.PromiseContext_BeginUnlocked("concurrent work")
+				time.Sleep(time.Microsecond * time.Duration(w))
+				TnT.PromiseContext_End(p)
+			}
+
+		}(w)
+	}
+
+	wg.Wait()
+
+	for _, ctx := range contenders {
+		TnT.PromiseContext_End(ctx)
+	}
+
+	failed := false
+
+	if ready.Load() != 1 {
+		fmt.Println("FAIL: the contended lock was granted",ready.Load(),"times")
+		failed = true
+	}
+
+	counter := TnT.GetKV("concurrency","counter")
+
+	if counter.V != WORKERS * ROUNDS {
+		fmt.Println("FAIL: counter is",counter.V,"expected",WORKERS * ROUNDS)
+		failed = true
+	}
+
+	exists, e := TnT.GetPromiseHistory(TnT.PROMISE_COLLECTION,TnT.PromiseName("concurrent work"))
+
+	if !exists || e.Sketch == nil || e.Sketch.Count < WORKERS * ROUNDS {
+		fmt.Println("FAIL: lost samples in the promise history",e.Sketch)
+		failed = true
+	}
+
+	// Leave the counter at zero for the next run
+
+	TnT.AddKV("concurrency",TnT.KeyValue{ K: "counter" })
+
+	if failed {
+		os.Exit(1)
+	}
+
+	fmt.Println("OK:",WORKERS,"workers,",ready.Load(),"lock holder,",counter.V,"increments,",e.Sketch.Count,"samples")
+}
@@ -48,5 +48,22 @@ func main() {
 
 		TnT.ContextActive("state_flag")
 	}
+
+	// Independent contexts, e.g. one per tenant, alongside the default
+
+	tenants := map[string]*TnT.Context{ "blue": TnT.NewContext(), "green": TnT.NewContext() }
+
+	tenants["blue"].Activate("state_of_contention")
+	tenants["green"].Set("state_flag",0.9)
+
+	for _, name := range []string{ "blue", "green" } {
+
+		ctx := tenants[name]
+		fmt.Println("Tenant",name,ctx.Members(),"policy active:",ctx.IsDefined(policy_condition))
+	}
+
+	// What used to be read from the CONTEXT map
+
+	fmt.Println("Default confidences",TnT.ContextValues())
 }
 
@@ -108,6 +108,36 @@ func main() {
 	expr5,res5 := TnT.ContextEval(str5)
 	fmt.Println("11.",str5,"---->",expr5,res5,"CMP",cmp5,"\n")
 
+	// *************
+
+	// Compile once, evaluate as the context changes
+
+	policy, err := TnT.Compile("(a | b) & !busy")
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println("12.",policy,"depends on",policy.Classes(),"---->",policy.Confidence())
+
+	TnT.SetContext("busy",1)
+
+	fmt.Println("13.",policy,"when busy ---->",policy.Confidence())
+
+	_, err = TnT.Compile(str3a)
+	fmt.Println("14.",err)
+
+	// The same expression under each algebra, a & a is only a if AND is idempotent
+
+	TnT.SetContext("a",0.6)
+	TnT.SetContext("b",0.7)
+
+	twice := TnT.MustCompile("a & a & b | b")
+
+	for i, algebra := range []TnT.Algebra{ TnT.PRODUCT_ALGEBRA, TnT.ZADEH_ALGEBRA, TnT.LUKASIEWICZ_ALGEBRA } {
+		fmt.Printf("%d. %s with %s ----> %.3f\n",15+i,twice,algebra.Name,twice.ConfidenceWith(algebra))
+	}
 
 }
 
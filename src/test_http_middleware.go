@@ -0,0 +1,76 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ****************************************************************************
+
+// Method and wildcard route patterns, even when built without a go.mod
+
+//go:debug httpmuxgo121=0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"TnT"
+)
+
+// ***********************************************************************
+
+func main() {
+
+	TnT.SetInstrumentationSink(TnT.NullSink{})
+
+	mux := http.NewServeMux()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w,"hello",r.PathValue("id"))
+	})
+
+	broken := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w,"not today",http.StatusServiceUnavailable)
+	})
+
+	// Promises are named by route pattern
+
+	mux.Handle("GET /items/{id}",TnT.PromiseMiddleware(ok))
+	mux.Handle("GET /broken",TnT.PromiseMiddleware(broken))
+
+	// Only one report per minute, extra requests are refused
+
+	TnT.SetPromisePolicy("GET /report",TnT.PromisePolicy{ IfElapsed: 60, ExpireAfter: 10 })
+	mux.Handle("GET /report",&TnT.PromiseHandler{ Next: ok, Reject: true })
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, path := range []string{"/items/1","/items/2","/broken","/report","/report"} {
+
+		resp, err := http.Get(server.URL+path)
+
+		if err != nil {
+			fmt.Println("Request failed",err)
+			continue
+		}
+
+		resp.Body.Close()
+		fmt.Println(path,resp.Status)
+	}
+
+	for _, name := range []string{"GET /items/{id}","GET /broken","GET /report"} {
+		fmt.Println(name,TnT.GetOutcomes(name),TnT.GetHTTPStatusCounts(name))
+	}
+}
@@ -0,0 +1,74 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ****************************************************************************
+//
+// Check that a service lock is refused until ifelapsed seconds have passed
+// since it was last completed, and granted again after that
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"TnT"
+)
+
+// ***********************************************************************
+
+func main() {
+
+	const ifelapsed = 30
+	const expireafter = 60
+
+	// A fresh name each run, so earlier runs leave nothing behind
+
+	name := fmt.Sprintf("ifelapsed-check-%d",time.Now().UnixNano())
+
+	now := time.Now()
+	failed := false
+
+	check := func(what string, lock TnT.Lock, want bool) {
+
+		result := "ok"
+
+		if lock.Ready != want {
+			result = "FAILED"
+			failed = true
+		}
+
+		fmt.Printf("%-45s ready %-5v want %-5v %s\n",what,lock.Ready,want,result)
+	}
+
+	first := TnT.BeginService(name,ifelapsed,expireafter,now.UnixNano())
+	check("first call",first,true)
+	TnT.EndService(first)
+
+	soon := TnT.BeginService(name,ifelapsed,expireafter,now.Add(time.Second).UnixNano())
+	check("1 s after the last completion",soon,false)
+
+	later := TnT.BeginService(name,ifelapsed,expireafter,now.Add((ifelapsed+1)*time.Second).UnixNano())
+	check(fmt.Sprintf("%d s after the last completion",ifelapsed+1),later,true)
+	TnT.EndService(later)
+
+	TnT.RemoveLock(later.Last)
+
+	if failed {
+		os.Exit(1)
+	}
+}
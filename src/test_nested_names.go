@@ -0,0 +1,120 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ****************************************************************************
+//
+// Check that child promises keep histories of their own: under a parent
+// whose name is longer than a key, and apart from a flat promise whose
+// name differs only by the '/'
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"TnT"
+)
+
+// ***********************************************************************
+
+func main() {
+
+	// A scratch store, so earlier runs leave nothing behind
+
+	dir, err := os.MkdirTemp("","TnT_nested_")
+
+	if err != nil {
+		fmt.Println("Unable to make a scratch store",err)
+		os.Exit(1)
+	}
+
+	defer os.RemoveAll(dir)
+
+	TnT.KVDIR = dir+"/"
+
+	failed := false
+
+	check := func(what string, ok bool) {
+
+		result := "ok"
+
+		if !ok {
+			result = "FAILED"
+			failed = true
+		}
+
+		fmt.Printf("%-55s %s\n",what,result)
+	}
+
+	now := time.Now()
+
+	// A parent longer than the 40 characters of a key
+
+	parent := TnT.StampedPromiseContext_BeginUnlocked("nightly-database-backup-for-the-production-cluster",now)
+
+	fetch := TnT.StampedPromiseContext_BeginChild(&parent,"fetch",now)
+	TnT.StampedPromiseContext_End(fetch,now.Add(2*time.Second))
+
+	verify := TnT.StampedPromiseContext_BeginChild(&parent,"verify",now.Add(2*time.Second))
+	TnT.StampedPromiseContext_End(verify,now.Add(5*time.Second))
+
+	_, shares := TnT.StampedPromiseContext_EndRollup(parent,now.Add(10*time.Second))
+
+	pkey := TnT.PromiseKey(parent.Name)
+	fkey := TnT.PromiseKey(fetch.Name)
+	vkey := TnT.PromiseKey(verify.Name)
+
+	fmt.Println("Keys:",pkey,fkey,vkey)
+
+	check("children have keys of their own",fkey != vkey && fkey != pkey && vkey != pkey)
+
+	_, p := TnT.GetPromiseHistory(TnT.PROMISE_COLLECTION,pkey)
+	_, f := TnT.GetPromiseHistory(TnT.PROMISE_COLLECTION,fkey)
+	_, v := TnT.GetPromiseHistory(TnT.PROMISE_COLLECTION,vkey)
+
+	check("the parent's latency is its own (10 s)",p.Q == float64(10*time.Second))
+	check("fetch's latency is its own (2 s)",f.Q == float64(2*time.Second))
+	check("verify's latency is its own (3 s)",v.Q == float64(3*time.Second))
+
+	check("the parent's last latency is its own",TnT.GetKV(TnT.PROMISE_COLLECTION,pkey+"latency").V == p.Q)
+	check("the rollup has the parent and both children",len(shares) == 3)
+
+	rollup := TnT.GetPromiseRollup("nightly-database-backup-for-the-production-cluster")
+
+	check("the learned rollup has the parent and both children",len(rollup) == 3)
+
+	// A child deploy/fetch and a flat promise "deploy fetch"
+
+	deploy := TnT.StampedPromiseContext_BeginUnlocked("deploy",now)
+	child := TnT.StampedPromiseContext_BeginChild(&deploy,"fetch",now)
+	TnT.StampedPromiseContext_End(child,now.Add(time.Second))
+
+	flat := TnT.StampedPromiseContext_BeginUnlocked("deploy fetch",now)
+	TnT.StampedPromiseContext_End(flat,now.Add(4*time.Second))
+
+	_, c := TnT.GetPromiseHistory(TnT.PROMISE_COLLECTION,TnT.PromiseKey(child.Name))
+	_, d := TnT.GetPromiseHistory(TnT.PROMISE_COLLECTION,TnT.PromiseName("deploy fetch"))
+
+	check("deploy/fetch and \"deploy fetch\" have different keys",TnT.PromiseKey(child.Name) != TnT.PromiseName("deploy fetch"))
+	check("deploy/fetch's latency is its own (1 s)",c.Q == float64(time.Second))
+	check("\"deploy fetch\"'s latency is its own (4 s)",d.Q == float64(4*time.Second))
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,64 @@
+//
+// Copyright © Mark Burgess, ChiTek-i (2023)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ****************************************************************************
+//
+// Observe a queue depth next to the latency of the same promise, and ask
+// for quantiles of each
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"TnT"
+)
+
+// ***********************************************************************
+
+func main() {
+
+	const name = "checkout"
+
+	TnT.InitializeContext()
+	TnT.SetInstrumentationSink(TnT.NullSink{})  // just the answers
+
+	start := time.Now()
+
+	for i := 0; i < 100; i++ {
+
+		t := start.Add(time.Duration(i) * time.Second)
+
+		// The work takes 10 to 19 ms, while 0 to 49 items wait
+
+		ctx := TnT.StampedPromiseContext_BeginUnlocked(name,t)
+		TnT.StampedPromiseContext_End(ctx,t.Add(time.Duration(10+i%10) * time.Millisecond))
+
+		TnT.StampedObserve(name,float64(i%50),"items",t)
+	}
+
+	_, slot := TnT.DoughNowt(start)
+
+	for _, q := range []float64{ 0.5, 0.95, 0.99 } {
+
+		_, latency := TnT.GetPromiseQuantile(name,q)
+		_, depth := TnT.GetObservedQuantile(name,q)
+		_, depth_now := TnT.GetObservedSlotQuantile(name,slot,q)
+
+		fmt.Printf("p%-3.0f latency %6.2f ms   queue depth %5.1f items (this timeslot %5.1f)\n",q*100,latency/1e6,depth,depth_now)
+	}
+}
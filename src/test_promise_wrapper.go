@@ -31,9 +31,13 @@ func main() {
 
 	for transactions := 1; transactions < many; transactions++ { 
 		
-		ctx := TnT.PromiseContext_Begin(name)
+		ctx, err := TnT.PromiseContext_TryBegin(name)
 
-		fmt.Println("Do something atomic")
+		if err != nil {
+			fmt.Println("Refused:",err)
+		} else {
+			fmt.Println("Do something atomic")
+		}
 		
 		TnT.PromiseContext_End(ctx)
 	}
@@ -0,0 +1,422 @@
+//
+// Copyright © Mark Burgess
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ****************************************************************************
+//
+// Replay a log of timed transactions through the stamped promise wrappers,
+// to rebuild the histories, weekly periodograms and reliabilities that
+// live traffic would have produced.
+//
+//   go run tnt_replay.go [-kvdir dir] [-bound 0.5] [-interval 60] [-week] [-v] log.csv log.jsonl ...
+//
+// The histories are written to a new scratch directory, or to -kvdir, which
+// must be empty unless -append is given, so a replay never mixes with the
+// live store or with an earlier replay by accident.
+//
+// CSV rows are   name,start,end[,quality]   (an optional header names the columns)
+// JSON lines are {"name": ..., "start": ..., "end": ..., "quality": ...}
+//
+// Times are RFC3339 strings or epoch seconds (with a fraction if you like).
+// Quality is the assessed payload between 0 and 1, default 1.
+//
+// ****************************************************************************
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"TnT"
+)
+
+// ***********************************************************************
+
+type Record struct {
+
+	Name    string
+	Start   time.Time
+	End     time.Time
+	Quality float64
+}
+
+// ***********************************************************************
+
+func main() {
+
+	bound := flag.Float64("bound",TnT.DEFAULT_PROMISE_BOUND.Latency,"promised latency bound (s) for assessment, 0 = don't assess")
+	interval := flag.Float64("interval",TnT.DEFAULT_PROMISE_BOUND.Interval,"trusted sampling interval (s) for assessment")
+	week := flag.Bool("week",false,"print the weekly periodogram of each promise")
+	verbose := flag.Bool("v",false,"print the instrumentation of every replayed promise")
+	kvdir := flag.String("kvdir","","where to write the replayed histories, default a new scratch directory")
+	add := flag.Bool("append",false,"allow replaying into a -kvdir that already holds histories")
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr,"usage: tnt_replay [flags] file.csv|file.jsonl ...")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var records []Record
+
+	for _, filename := range flag.Args() {
+
+		r, err := ReadRecords(filename)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr,filename,err)
+			os.Exit(1)
+		}
+
+		records = append(records,r...)
+	}
+
+	// Learning assumes time moves forwards, and a promise is learned
+	// when it ends, so replay in order of completion
+
+	sort.SliceStable(records,func(i, j int) bool {
+		return records[i].End.Before(records[j].End)
+	})
+
+	if !*verbose {
+		TnT.SetInstrumentationSink(nil)
+	}
+
+	if err := UseKVDir(*kvdir,*add); err != nil {
+		fmt.Fprintln(os.Stderr,err)
+		os.Exit(1)
+	}
+
+	TnT.InitializeContext()
+
+	var names []string
+	last := make(map[string]TnT.PromiseHistory)
+	reliability := make(map[string]float64)
+
+	for _, r := range records {
+
+		// Locking is bypassed, the log already says what happened
+
+		ctx := TnT.StampedPromiseContext_BeginUnlocked(r.Name,r.Start)
+		e := TnT.StampedPromiseContext_End(ctx,r.End)
+
+		if _, seen := last[ctx.Name]; !seen {
+			names = append(names,ctx.Name)
+		}
+
+		last[ctx.Name] = e
+
+		if *bound > 0 {
+			reliability[ctx.Name] = TnT.AssessPromiseOutcome(e,r.Quality,*bound,*interval)
+		}
+	}
+
+	sort.Strings(names)
+
+	fmt.Printf("Replayed %d records of %d promises into %s\n\n",len(records),len(names),TnT.KVDIR)
+
+	for _, name := range names {
+
+		Summary(name,reliability,*bound > 0)
+
+		if *week {
+			Periodogram(name)
+		}
+	}
+
+	fmt.Println("\nContext classes:",TnT.ContextSet())
+}
+
+// ***********************************************************************
+
+func UseKVDir(dir string, add bool) error {
+
+	// Point the KV store away from the live one before anything is learned
+
+	if dir == "" {
+
+		scratch, err := os.MkdirTemp("","TnT_replay_")
+
+		if err != nil {
+			return err
+		}
+
+		TnT.KVDIR = scratch+"/"
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err == nil && len(entries) > 0 && !add {
+		return fmt.Errorf("%s already holds histories, use -append to add to them",dir)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	TnT.KVDIR = strings.TrimSuffix(dir,"/")+"/"
+	return nil
+}
+
+// ***********************************************************************
+
+func Summary(name string, reliability map[string]float64, assessed bool) {
+
+	_, e := TnT.GetPromiseHistory(TnT.PROMISE_COLLECTION,name)
+
+	var n float64
+
+	if e.Sketch != nil {
+		n = e.Sketch.Count
+	}
+
+	_, p50 := TnT.GetPromiseQuantile(name,0.5)
+	_, p95 := TnT.GetPromiseQuantile(name,0.95)
+	_, p99 := TnT.GetPromiseQuantile(name,0.99)
+
+	fmt.Printf("%s: %.0f samples, latency %.3f +- %.3f s, p50 %.3f p95 %.3f p99 %.3f s, interval %.1f s",
+		name,n,e.Q_av/TnT.NANO,math.Sqrt(e.Q_var)/TnT.NANO,p50/TnT.NANO,p95/TnT.NANO,p99/TnT.NANO,e.Dt_av/TnT.NANO)
+
+	if assessed {
+		fmt.Printf(", last reliability %.3f",reliability[name])
+	}
+
+	fmt.Println()
+}
+
+// ***********************************************************************
+
+func Periodogram(name string) {
+
+	// Only the timeslots that were seen
+
+	var now int64
+	i := 0
+
+	data := TnT.GetPromiseWeekMemory(name)
+
+	for now = TnT.CF_MONDAY_MORNING; now < TnT.CF_MONDAY_MORNING + TnT.SECONDS_PER_WEEK; now += TnT.CF_MEASURE_INTERVAL {
+
+		if data[i] != 0 {
+			fmt.Printf("   %s %.3f s\n",TnT.GetUnixTimeKey(now),data[i]/TnT.NANO)
+		}
+
+		i++
+	}
+}
+
+// ***********************************************************************
+
+func ReadRecords(filename string) ([]Record, error) {
+
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	if strings.HasSuffix(filename,".jsonl") || strings.HasSuffix(filename,".json") {
+		return ReadJSONLines(f)
+	}
+
+	return ReadCSV(f)
+}
+
+// ***********************************************************************
+
+func ReadCSV(f io.Reader) ([]Record, error) {
+
+	var records []Record
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	rows, err := reader.ReadAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	column := map[string]int{ "name": 0, "start": 1, "end": 2, "quality": 3 }
+
+	if len(rows) > 0 && strings.EqualFold(strings.TrimSpace(rows[0][0]),"name") {
+
+		column = make(map[string]int)
+
+		for i, heading := range rows[0] {
+			column[strings.ToLower(strings.TrimSpace(heading))] = i
+		}
+
+		rows = rows[1:]
+	}
+
+	field := func(row []string, name string) string {
+
+		i, ok := column[name]
+
+		if !ok || i >= len(row) {
+			return ""
+		}
+
+		return strings.TrimSpace(row[i])
+	}
+
+	for line, row := range rows {
+
+		var r Record
+
+		r.Name = field(row,"name")
+		r.Start, err = ParseTime(field(row,"start"))
+
+		if err == nil {
+			r.End, err = ParseTime(field(row,"end"))
+		}
+
+		if err == nil {
+			r.Quality, err = ParseQuality(field(row,"quality"))
+		}
+
+		if err == nil && r.Name == "" {
+			err = fmt.Errorf("no name")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v",line+1,err)
+		}
+
+		records = append(records,r)
+	}
+
+	return records, nil
+}
+
+// ***********************************************************************
+
+func ReadJSONLines(f io.Reader) ([]Record, error) {
+
+	var records []Record
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+
+	for scanner.Scan() {
+
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" {
+			continue
+		}
+
+		var raw struct {
+			Name    string           `json:"name"`
+			Start   json.RawMessage  `json:"start"`
+			End     json.RawMessage  `json:"end"`
+			Quality *float64         `json:"quality"`
+		}
+
+		err := json.Unmarshal([]byte(text),&raw)
+
+		var r Record
+
+		if err == nil {
+			r.Name = raw.Name
+			r.Start, err = ParseTime(Unquote(raw.Start))
+		}
+
+		if err == nil {
+			r.End, err = ParseTime(Unquote(raw.End))
+		}
+
+		r.Quality = 1
+
+		if raw.Quality != nil {
+			r.Quality = *raw.Quality
+		}
+
+		if err == nil && r.Name == "" {
+			err = fmt.Errorf("no name")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v",line,err)
+		}
+
+		records = append(records,r)
+	}
+
+	return records, scanner.Err()
+}
+
+// ***********************************************************************
+
+func Unquote(raw json.RawMessage) string {
+
+	// A time may be a JSON string or a number
+
+	var s string
+
+	if json.Unmarshal(raw,&s) == nil {
+		return s
+	}
+
+	return string(raw)
+}
+
+// ***********************************************************************
+
+func ParseTime(s string) (time.Time, error) {
+
+	if s == "" {
+		return time.Time{}, fmt.Errorf("missing time")
+	}
+
+	secs, err := strconv.ParseFloat(s,64)
+
+	if err == nil {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole),int64(frac * TnT.NANO)), nil
+	}
+
+	return time.Parse(time.RFC3339Nano,s)
+}
+
+// ***********************************************************************
+
+func ParseQuality(s string) (float64, error) {
+
+	if s == "" {
+		return 1, nil
+	}
+
+	return strconv.ParseFloat(s,64)
+}